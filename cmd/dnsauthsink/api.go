@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxQueryLimit caps the number of rows returned by /api/queries.
+const maxQueryLimit = 1000
+
+// API is the HTTP/JSON management interface of the sink.
+type API struct {
+	store *Store
+	stats *Stats
+	token string
+}
+
+// newAPIServer returns an HTTP server for the management API. The listen
+// address must be a loopback address.
+func newAPIServer(listen, token string, store *Store, stats *Stats) (*http.Server, error) {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("API listen address %s is not a loopback address", listen)
+	}
+	if token == "" {
+		return nil, fmt.Errorf("API token is required")
+	}
+
+	api := &API{store: store, stats: stats, token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/records", api.authorize(api.handleRecords))
+	mux.HandleFunc("/api/records/", api.authorize(api.handleRecord))
+	mux.HandleFunc("/api/queries", api.authorize(api.handleQueries))
+	mux.HandleFunc("/api/stats", api.authorize(api.handleStats))
+
+	return &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+	}, nil
+}
+
+// authorize rejects requests without the bearer token.
+func (a *API) authorize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleRecords lists (GET) and creates (POST) dns_records entries.
+func (a *API) handleRecords(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		records, err := a.store.ListRecords()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, records)
+	case http.MethodPost:
+		record, ok := decodeRecord(w, r)
+		if !ok {
+			return
+		}
+		record, err := a.store.CreateRecord(record)
+		if err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, record)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleRecord reads (GET), replaces (PUT) and deletes (DELETE) a single
+// dns_records entry addressed as /api/records/{id}.
+func (a *API) handleRecord(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/records/"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "invalid record id")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		record, err := a.store.GetRecord(id)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, record)
+	case http.MethodPut:
+		record, ok := decodeRecord(w, r)
+		if !ok {
+			return
+		}
+		record.ID = id
+		if err := a.store.UpdateRecord(record); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, record)
+	case http.MethodDelete:
+		if err := a.store.DeleteRecord(id); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleQueries returns recent dns_queries rows. Supported parameters are
+// qname, suffix, source_ip, qtype, action, since and until (RFC 3339) and
+// limit.
+func (a *API) handleQueries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	params := r.URL.Query()
+	filter := QueryFilter{
+		SourceIP: params.Get("source_ip"),
+		QType:    params.Get("qtype"),
+		Action:   params.Get("action"),
+		Limit:    100,
+	}
+	if qname := params.Get("qname"); qname != "" {
+		filter.QName = dns.Fqdn(qname)
+	}
+	if suffix := params.Get("suffix"); suffix != "" {
+		filter.Suffix = dns.Fqdn(suffix)
+	}
+
+	var err error
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := params.Get(name); value != "" {
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s: %v", name, err))
+				return
+			}
+		}
+	}
+	if value := params.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 1 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		if filter.Limit > maxQueryLimit {
+			filter.Limit = maxQueryLimit
+		}
+	}
+
+	queries, err := a.store.RecentQueries(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, queries)
+}
+
+// handleStats returns live query statistics. The top parameter sets the
+// number of qnames and sources listed (default 10).
+func (a *API) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	top := 10
+	if value := r.URL.Query().Get("top"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "invalid top")
+			return
+		}
+		top = n
+	}
+	writeJSON(w, http.StatusOK, a.stats.Snapshot(top))
+}
+
+// decodeRecord reads and validates a record from the request body.
+func decodeRecord(w http.ResponseWriter, r *http.Request) (Record, bool) {
+	var record Record
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&record); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid record: %v", err))
+		return Record{}, false
+	}
+	if _, ok := dns.IsDomainName(record.QName); !ok || record.QName == "" {
+		writeError(w, http.StatusBadRequest, "invalid qname")
+		return Record{}, false
+	}
+	if net.ParseIP(record.Answer) == nil {
+		writeError(w, http.StatusBadRequest, "answer must be an IP address")
+		return Record{}, false
+	}
+	record.QName = dns.Fqdn(record.QName)
+	return record, true
+}
+
+// writeStoreError maps a store error to an HTTP error response.
+func writeStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "record not found")
+		return
+	}
+	writeError(w, http.StatusConflict, err.Error())
+}
+
+// writeError writes a JSON error response.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// benchResult collects the outcome of the queries sent by one bench worker.
+type benchResult struct {
+	latencies []time.Duration
+	rcodes    map[int]int
+	errors    int
+	truncated int
+}
+
+// runBench implements the bench subcommand, a load generator that measures
+// the query rate and latency of a running dnsauthsink.
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	server := fs.String("server", "127.0.0.1:53", "Address of the DNS server to load")
+	queries := fs.Int("queries", 100000, "Total number of queries to send")
+	concurrency := fs.Int("concurrency", 50, "Number of concurrent clients")
+	zone := fs.String("zone", "bench.example.com", "Zone to query names under")
+	qtype := fs.String("qtype", "A", "Query type")
+	random := fs.Bool("random", true, "Prefix each name with a random label to defeat caching")
+	tcp := fs.Bool("tcp", false, "Query over TCP instead of UDP")
+	timeout := fs.Int("timeout", 2000, "Query timeout in milliseconds")
+	fs.Parse(args)
+
+	rrtype, ok := dns.StringToType[strings.ToUpper(*qtype)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown query type %q\n", *qtype)
+		os.Exit(1)
+	}
+
+	client := &dns.Client{Timeout: time.Duration(*timeout) * time.Millisecond}
+	if *tcp {
+		client.Net = "tcp"
+	}
+
+	var sent atomic.Int64
+	results := make([]benchResult, *concurrency)
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func(result *benchResult) {
+			defer wg.Done()
+			result.rcodes = make(map[int]int)
+			for sent.Add(1) <= int64(*queries) {
+				name := dns.Fqdn(*zone)
+				if *random {
+					name = fmt.Sprintf("%08x.%s", rand.Uint32(), name)
+				}
+
+				msg := new(dns.Msg)
+				msg.SetQuestion(name, rrtype)
+				resp, rtt, err := client.Exchange(msg, *server)
+				if err != nil {
+					result.errors++
+					continue
+				}
+				result.latencies = append(result.latencies, rtt)
+				result.rcodes[resp.Rcode]++
+				if resp.Truncated {
+					result.truncated++
+				}
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	printBenchSummary(results, elapsed)
+}
+
+// printBenchSummary prints throughput, response codes and latency percentiles.
+func printBenchSummary(results []benchResult, elapsed time.Duration) {
+	var latencies []time.Duration
+	rcodes := make(map[int]int)
+	errors, truncated := 0, 0
+	for _, result := range results {
+		latencies = append(latencies, result.latencies...)
+		for rcode, count := range result.rcodes {
+			rcodes[rcode] += count
+		}
+		errors += result.errors
+		truncated += result.truncated
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Printf("Duration:   %v\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("Responses:  %d (%.0f qps)\n", len(latencies), float64(len(latencies))/elapsed.Seconds())
+	fmt.Printf("Errors:     %d\n", errors)
+	fmt.Printf("Truncated:  %d\n", truncated)
+	for rcode, count := range rcodes {
+		fmt.Printf("Rcode %-8s %d\n", dns.RcodeToString[rcode]+":", count)
+	}
+	if len(latencies) == 0 {
+		return
+	}
+	for _, p := range []float64{50, 90, 99} {
+		fmt.Printf("Latency p%.0f: %v\n", p, latencies[int(float64(len(latencies)-1)*p/100)])
+	}
+	fmt.Printf("Latency max: %v\n", latencies[len(latencies)-1])
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	jsonllogger "github.com/clwg/netsecutils/pkg/logging"
+	"github.com/miekg/dns"
+	"github.com/patrickmn/go-cache"
+)
+
+const createCanaryTokensTable = `CREATE TABLE IF NOT EXISTS canary_tokens (
+	id INTEGER PRIMARY KEY,
+	token TEXT UNIQUE,
+	zone TEXT,
+	description TEXT,
+	owner TEXT,
+	created DATETIME
+);`
+
+// labelEncoding is the unpadded lower case base32 alphabet used for tokens
+// and accepted for data carried in extra labels.
+var labelEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// CanaryToken is a row of the canary_tokens table.
+type CanaryToken struct {
+	ID          int64     `json:"id"`
+	Token       string    `json:"token"`
+	Zone        string    `json:"zone"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Owner       string    `json:"owner"`
+	Created     time.Time `json:"created"`
+}
+
+// CanaryAlert is emitted when a query for a canary token name arrives.
+type CanaryAlert struct {
+	Alert        string
+	Priority     string
+	Timestamp    time.Time
+	Token        string
+	Name         string
+	Description  string
+	Owner        string
+	Query        string
+	SourceIP     string
+	SourcePort   int
+	Transport    string
+	ClientSubnet string
+	ExtraLabels  []string `json:",omitempty"` // labels to the left of the token
+	DataEncoding string   `json:",omitempty"` // base32, hex or raw
+	Data         string   `json:",omitempty"` // extra labels decoded
+}
+
+// CanaryWatcher matches queries against the canary tokens in the database and
+// raises alerts to the JSON log and an optional webhook.
+type CanaryWatcher struct {
+	db      *sql.DB
+	webhook string
+	client  *http.Client
+	recent  *cache.Cache // suppresses repeated alerts from resolver retries; nil disables
+
+	mu     sync.RWMutex
+	tokens map[string]CanaryToken
+}
+
+// newCanaryWatcher loads the canary tokens and keeps them up to date. A dedup
+// window of zero or less raises an alert for every query.
+func newCanaryWatcher(db *sql.DB, webhook string, dedup time.Duration) (*CanaryWatcher, error) {
+	w := &CanaryWatcher{
+		db:      db,
+		webhook: webhook,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	if dedup > 0 {
+		w.recent = cache.New(dedup, 2*dedup+time.Second)
+	}
+	if err := w.reload(); err != nil {
+		return nil, err
+	}
+	go w.refresh(5 * time.Second)
+	return w, nil
+}
+
+// reload reads every canary token from the database.
+func (w *CanaryWatcher) reload() error {
+	tokens, err := listCanaryTokens(w.db)
+	if err != nil {
+		return err
+	}
+
+	byToken := make(map[string]CanaryToken, len(tokens))
+	for _, token := range tokens {
+		byToken[token.Token] = token
+	}
+
+	w.mu.Lock()
+	w.tokens = byToken
+	w.mu.Unlock()
+	return nil
+}
+
+// refresh periodically reloads the tokens so that new ones take effect
+// without a restart.
+func (w *CanaryWatcher) refresh(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := w.reload(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Match returns the alert for a query if its name contains a canary token.
+func (w *CanaryWatcher) Match(q DNSQuery) (CanaryAlert, bool) {
+	labels := dns.SplitDomainName(strings.ToLower(q.Query))
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	for i, label := range labels {
+		token, ok := w.tokens[label]
+		if !ok || dns.Fqdn(strings.Join(labels[i+1:], ".")) != token.Zone {
+			continue
+		}
+
+		alert := CanaryAlert{
+			Alert:       "canary_token_triggered",
+			Priority:    "high",
+			Timestamp:   q.Timestamp,
+			Token:       token.Token,
+			Name:        token.Name,
+			Description: token.Description,
+			Owner:       token.Owner,
+			Query:       q.Query,
+			SourceIP:    q.SourceIP,
+			SourcePort:  q.SourcePort,
+			Transport:   q.Transport,
+		}
+		if q.EDNS != nil {
+			alert.ClientSubnet = q.EDNS.ClientSubnet
+		}
+		if i > 0 {
+			// Keep the original case, which matters for raw data.
+			alert.ExtraLabels = dns.SplitDomainName(q.Query)[:i]
+			alert.DataEncoding, alert.Data = decodeLabels(alert.ExtraLabels)
+		}
+		return alert, true
+	}
+	return CanaryAlert{}, false
+}
+
+// Raise logs an alert and posts it to the webhook. Repeats of the same query
+// from the same source within the deduplication window are ignored.
+func (w *CanaryWatcher) Raise(alert CanaryAlert, jsonLogger *jsonllogger.Logger) {
+	if w.recent != nil {
+		key := alert.SourceIP + "|" + strings.ToLower(alert.Query)
+		if err := w.recent.Add(key, struct{}{}, cache.DefaultExpiration); err != nil {
+			return
+		}
+	}
+
+	jsonLogger.Log(alert)
+	log.Printf("Canary token %s (%s) triggered by %s", alert.Token, alert.Description, alert.SourceIP)
+
+	if w.webhook != "" {
+		go w.post(alert)
+	}
+}
+
+// post sends an alert to the webhook as JSON.
+func (w *CanaryWatcher) post(alert CanaryAlert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	resp, err := w.client.Post(w.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Canary webhook failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Canary webhook returned %s", resp.Status)
+	}
+}
+
+// decodeLabels decodes data carried in the labels to the left of a token,
+// trying base32 and hex before falling back to the raw text.
+func decodeLabels(labels []string) (string, string) {
+	joined := strings.Join(labels, "")
+
+	if data, err := labelEncoding.DecodeString(strings.ToUpper(joined)); err == nil && utf8.Valid(data) {
+		return "base32", string(data)
+	}
+	if data, err := hex.DecodeString(joined); err == nil && utf8.Valid(data) {
+		return "hex", string(data)
+	}
+	return "raw", strings.Join(labels, ".")
+}
+
+// newCanaryToken returns a random token label.
+func newCanaryToken() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return strings.ToLower(labelEncoding.EncodeToString(b)), nil
+}
+
+// createCanaryToken generates and stores a new token under zone.
+func createCanaryToken(db *sql.DB, zone, description, owner string) (CanaryToken, error) {
+	token, err := newCanaryToken()
+	if err != nil {
+		return CanaryToken{}, err
+	}
+
+	t := CanaryToken{
+		Token:       token,
+		Zone:        strings.ToLower(dns.Fqdn(zone)),
+		Description: description,
+		Owner:       owner,
+		Created:     time.Now(),
+	}
+	t.Name = t.Token + "." + t.Zone
+
+	result, err := db.Exec("INSERT INTO canary_tokens (token, zone, description, owner, created) VALUES (?, ?, ?, ?, ?)",
+		t.Token, t.Zone, t.Description, t.Owner, t.Created)
+	if err != nil {
+		return CanaryToken{}, err
+	}
+	t.ID, err = result.LastInsertId()
+	return t, err
+}
+
+// listCanaryTokens returns every canary token.
+func listCanaryTokens(db *sql.DB) ([]CanaryToken, error) {
+	rows, err := db.Query("SELECT id, token, zone, description, owner, created FROM canary_tokens ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []CanaryToken
+	for rows.Next() {
+		var t CanaryToken
+		if err := rows.Scan(&t.ID, &t.Token, &t.Zone, &t.Description, &t.Owner, &t.Created); err != nil {
+			return nil, err
+		}
+		t.Name = t.Token + "." + t.Zone
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// runToken implements the token subcommand, which creates, lists and deletes
+// canary tokens.
+func runToken(args []string) {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	dbPath := fs.String("db", "./dns.db", "SQLite database file")
+	zone := fs.String("zone", "", "Zone to create the token under")
+	description := fs.String("description", "", "Where the token is planted")
+	owner := fs.String("owner", "", "Who to notify when the token fires")
+	list := fs.Bool("list", false, "List existing tokens")
+	remove := fs.String("delete", "", "Delete the given token")
+	fs.Parse(args)
+
+	db, err := initDB(*dbPath)
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	switch {
+	case *list:
+		tokens, err := listCanaryTokens(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printJSON(tokens)
+	case *remove != "":
+		result, err := db.Exec("DELETE FROM canary_tokens WHERE token = ?", strings.ToLower(*remove))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := expectOneRow(result); err != nil {
+			log.Fatalf("Token %s not found", *remove)
+		}
+	default:
+		if *zone == "" {
+			fmt.Fprintln(os.Stderr, "token: -zone is required")
+			fs.Usage()
+			os.Exit(2)
+		}
+		token, err := createCanaryToken(db, *zone, *description, *owner)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printJSON(token)
+	}
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(data))
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/clwg/netsecutils/pkg/sqliteutil"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/patrickmn/go-cache"
+)
+
+// Store wraps the SQLite database with prepared statements, a cache of
+// dns_records answers and a background writer that inserts log rows in batches
+// so that request goroutines never wait on the database.
+type Store struct {
+	db                 *sql.DB
+	findAnswerStmt     *sql.Stmt
+	insertQueryStmt    *sql.Stmt
+	insertPathStmt     *sql.Stmt
+	answerCache        *cache.Cache
+	recordsVersion     int64
+	rows               chan pendingRow
+	batchSize          int
+	batchInterval      time.Duration
+	dropped            atomic.Int64
+	done               chan struct{}
+	stopVersionPolling chan struct{}
+	mu                 sync.RWMutex // guards closed
+	closed             bool
+}
+
+// maxCachedMisses bounds the answer cache, so that a scan of random names
+// cannot grow it without limit: beyond it misses are no longer cached.
+const maxCachedMisses = 100000
+
+// pendingRow is a row waiting to be written by the background writer.
+type pendingRow struct {
+	stmt *sql.Stmt
+	args []interface{}
+}
+
+// openStore opens the database at path, creating and upgrading its schema, and
+// starts the background writer.
+func openStore(path string, batchSize int, batchInterval time.Duration) (*Store, error) {
+	db, err := initDB(path)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &Store{
+		db:                 db,
+		answerCache:        cache.New(5*time.Minute, 10*time.Minute),
+		rows:               make(chan pendingRow, 10*batchSize),
+		batchSize:          batchSize,
+		batchInterval:      batchInterval,
+		done:               make(chan struct{}),
+		stopVersionPolling: make(chan struct{}),
+	}
+
+	statements := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&store.findAnswerStmt, "SELECT answer FROM dns_records WHERE qname = ?"},
+		{&store.insertQueryStmt, insertQueryStatement},
+		{&store.insertPathStmt, insertForwardingPathStatement},
+	}
+	for _, s := range statements {
+		*s.stmt, err = db.Prepare(s.query)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("preparing %q: %w", s.query, err)
+		}
+	}
+
+	if err := db.QueryRow("SELECT version FROM dns_records_version").Scan(&store.recordsVersion); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	go store.writeBatches()
+	go store.pollRecordsVersion(time.Second)
+	return store, nil
+}
+
+// initDB initializes and returns a new database connection.
+func initDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	createTableQuery := `CREATE TABLE IF NOT EXISTS dns_records (
+		id INTEGER PRIMARY KEY,
+		qname TEXT,
+		answer TEXT,
+		UNIQUE(qname)
+	);
+	CREATE TABLE IF NOT EXISTS dns_queries (
+		id INTEGER PRIMARY KEY,
+		source_ip TEXT,
+		qname TEXT,
+		timestamp DATETIME
+	);`
+
+	_, err = db.Exec(createTableQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sqliteutil.AddMissingColumns(db, "dns_queries", queryColumns); err != nil {
+		return nil, err
+	}
+
+	createIndexQuery := `CREATE INDEX IF NOT EXISTS idx_dns_queries_qname ON dns_queries (qname);
+	CREATE INDEX IF NOT EXISTS idx_dns_queries_timestamp ON dns_queries (timestamp);`
+
+	_, err = db.Exec(createIndexQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(createForwardingPathsTable)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := sqliteutil.AddMissingColumns(db, "forwarding_paths", forwardingPathColumns); err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(createCanaryTokensTable)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every change to dns_records, including edits made with the sqlite3
+	// shell, bumps a version number that invalidates the answer cache.
+	createVersionQuery := `CREATE TABLE IF NOT EXISTS dns_records_version (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		version INTEGER NOT NULL
+	);
+	INSERT OR IGNORE INTO dns_records_version (id, version) VALUES (1, 0);
+	CREATE TRIGGER IF NOT EXISTS dns_records_inserted AFTER INSERT ON dns_records
+	BEGIN UPDATE dns_records_version SET version = version + 1; END;
+	CREATE TRIGGER IF NOT EXISTS dns_records_updated AFTER UPDATE ON dns_records
+	BEGIN UPDATE dns_records_version SET version = version + 1; END;
+	CREATE TRIGGER IF NOT EXISTS dns_records_deleted AFTER DELETE ON dns_records
+	BEGIN UPDATE dns_records_version SET version = version + 1; END;`
+
+	_, err = db.Exec(createVersionQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// FindAnswer returns the dns_records answer for qname, consulting the cache
+// first. The boolean result is false when there is no record.
+func (s *Store) FindAnswer(qname string) (string, bool) {
+	if cached, ok := s.answerCache.Get(qname); ok {
+		answer := cached.(string)
+		return answer, answer != ""
+	}
+
+	var answer string
+	err := s.findAnswerStmt.QueryRow(qname).Scan(&answer)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err)
+		return "", false
+	}
+
+	// Misses are cached as empty answers so that repeated queries for names
+	// without records do not reach the database either.
+	if answer != "" || s.answerCache.ItemCount() < maxCachedMisses {
+		s.answerCache.SetDefault(qname, answer)
+	}
+	return answer, answer != ""
+}
+
+// InvalidateAnswers empties the answer cache.
+func (s *Store) InvalidateAnswers() {
+	s.answerCache.Flush()
+}
+
+// LogQuery queues a dns_queries row for the background writer.
+func (s *Store) LogQuery(q DNSQuery) {
+	s.enqueue(s.insertQueryStmt, queryArgs(q))
+}
+
+// LogForwardingPath queues a forwarding_paths row for the background writer.
+func (s *Store) LogForwardingPath(path ForwardingPath) {
+	s.enqueue(s.insertPathStmt, forwardingPathArgs(path))
+}
+
+// enqueue hands a row to the background writer, dropping it when the queue is
+// full rather than blocking the caller.
+func (s *Store) enqueue(stmt *sql.Stmt, args []interface{}) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+
+	select {
+	case s.rows <- pendingRow{stmt: stmt, args: args}:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// writeBatches writes queued rows in transactions of up to batchSize rows, or
+// whatever has accumulated after batchInterval.
+func (s *Store) writeBatches() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.batchInterval)
+	defer ticker.Stop()
+
+	batch := make([]pendingRow, 0, s.batchSize)
+	for {
+		select {
+		case row, ok := <-s.rows:
+			if !ok {
+				s.flush(batch)
+				return
+			}
+			batch = append(batch, row)
+			if len(batch) >= s.batchSize {
+				s.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			s.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush writes a batch of rows in a single transaction.
+func (s *Store) flush(batch []pendingRow) {
+	if dropped := s.dropped.Swap(0); dropped > 0 {
+		log.Printf("Dropped %d database rows, writer queue full", dropped)
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	txStmts := make(map[*sql.Stmt]*sql.Stmt)
+	for _, row := range batch {
+		txStmt, ok := txStmts[row.stmt]
+		if !ok {
+			txStmt = tx.Stmt(row.stmt)
+			txStmts[row.stmt] = txStmt
+		}
+		if _, err := txStmt.Exec(row.args...); err != nil {
+			log.Println(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+	}
+}
+
+// pollRecordsVersion flushes the answer cache whenever dns_records changes.
+func (s *Store) pollRecordsVersion(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopVersionPolling:
+			return
+		case <-ticker.C:
+		}
+
+		var version int64
+		if err := s.db.QueryRow("SELECT version FROM dns_records_version").Scan(&version); err != nil {
+			log.Println(err)
+			continue
+		}
+		if version != s.recordsVersion {
+			s.recordsVersion = version
+			s.InvalidateAnswers()
+		}
+	}
+}
+
+// Close flushes queued rows and closes the database.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	close(s.rows)
+	s.mu.Unlock()
+
+	close(s.stopVersionPolling)
+	<-s.done
+	return s.db.Close()
+}
@@ -1,35 +1,102 @@
 package main
 
 import (
-	"database/sql"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/clwg/netsecutils/pkg/dnsrecord"
 	jsonllogger "github.com/clwg/netsecutils/pkg/logging"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/clwg/netsecutils/pkg/probename"
 	"github.com/miekg/dns"
 )
 
-// DNSQuery represents a DNS query with source IP, query name, and timestamp.
+// DNSQuery represents a DNS query with its transport details, header flags,
+// EDNS0 options and the response it received.
 type DNSQuery struct {
-	SourceIP  string
-	Query     string
-	Answer    string
-	Timestamp time.Time
+	SourceIP         string
+	SourcePort       int
+	Transport        string
+	ID               uint16
+	Query            string
+	QType            string
+	QClass           string
+	CasePattern      string // 0x20 case pattern of the query name
+	RecursionDesired bool
+	CheckingDisabled bool
+	DO               bool
+	QuerySize        int
+	Rcode            string
+	Action           string // answer, slip, drop or deny
+	Answer           string
+	Timestamp        time.Time
+	EDNS             *EDNSInfo
 }
 
 // AppConfig holds configuration data.
 type AppConfig struct {
 	DefaultAnswer       string
 	ListenAddress       string
+	MaxUDPSize          uint16
 	UseSourceIPAsAnswer bool
+	ZoneFiles           []string
+	RulesFile           string
+	ReloadInterval      time.Duration
+	ProbeZone           string
+	ProbeEncoding       string
+	DictionaryFile      string
+	ProbeKey            string
+	DBPath              string
+	BatchSize           int
+	BatchInterval       time.Duration
+	APIListen           string
+	APIToken            string
+	CanaryWebhook       string
+	CanaryDedup         time.Duration
+	ExfilZone           string
+	ExfilEncoding       string
+	ExfilDir            string
+	ExfilTimeout        time.Duration
+	Guard               GuardConfig
 	LoggerConfig        jsonllogger.LoggerConfig
 }
 
+// Sink answers DNS queries and records them.
+type Sink struct {
+	config     AppConfig
+	store      *Store
+	jsonLogger *jsonllogger.Logger
+	answers    *AnswerStore
+	probes     *probename.Codec
+	stats      *Stats
+	guard      *Guard
+	canaries   *CanaryWatcher
+	exfil      *ExfilCollector
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			runBench(os.Args[2:])
+			return
+		case "token":
+			runToken(os.Args[2:])
+			return
+		case "exfil":
+			runExfil(os.Args[2:])
+			return
+		}
+	}
+
 	appConfig := parseFlags()
 
 	jsonLogger, err := jsonllogger.NewLogger(appConfig.LoggerConfig)
@@ -37,18 +104,90 @@ func main() {
 		log.Fatalf("Failed to initialize logger: %v", err)
 	}
 
-	db, err := initDB()
+	store, err := openStore(appConfig.DBPath, appConfig.BatchSize, appConfig.BatchInterval)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
-	defer db.Close()
 
-	server := setupDNSServer(appConfig, db, jsonLogger)
-	err = server.ListenAndServe()
+	answers, err := newAnswerStore(appConfig.ZoneFiles, appConfig.RulesFile)
+	if err != nil {
+		log.Fatalf("Failed to load zones and rules: %v", err)
+	}
+	go answers.Watch(appConfig.ReloadInterval)
+
+	probes, err := newProbeCodec(appConfig)
+	if err != nil {
+		log.Fatalf("Failed to initialize probe decoding: %v", err)
+	}
+
+	canaries, err := newCanaryWatcher(store.db, appConfig.CanaryWebhook, appConfig.CanaryDedup)
 	if err != nil {
-		log.Fatalf("Failed to start DNS server: %v", err)
+		log.Fatalf("Failed to load canary tokens: %v", err)
+	}
+
+	var exfil *ExfilCollector
+	if appConfig.ExfilZone != "" {
+		exfil, err = newExfilCollector(appConfig.ExfilZone, appConfig.ExfilEncoding, appConfig.ExfilDir, appConfig.ExfilTimeout, jsonLogger)
+		if err != nil {
+			log.Fatalf("Failed to initialize exfil reassembly: %v", err)
+		}
+	}
+
+	sink := &Sink{
+		config:     appConfig,
+		store:      store,
+		jsonLogger: jsonLogger,
+		answers:    answers,
+		probes:     probes,
+		stats:      newStats(),
+		guard:      newGuard(appConfig.Guard),
+		canaries:   canaries,
+		exfil:      exfil,
+	}
+
+	var apiServer *http.Server
+	if appConfig.APIListen != "" {
+		apiServer, err = newAPIServer(appConfig.APIListen, appConfig.APIToken, store, sink.stats)
+		if err != nil {
+			log.Fatalf("Failed to initialize management API: %v", err)
+		}
+		go func() {
+			if err := apiServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatalf("Failed to start management API: %v", err)
+			}
+		}()
+	}
+
+	servers := setupDNSServer(sink)
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *dns.Server) {
+			errs <- server.ListenAndServe()
+		}(server)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err = <-errs:
+		log.Printf("Failed to start DNS server: %v", err)
+	case <-stop:
+		log.Println("Shutting down")
+	}
+
+	for _, server := range servers {
+		server.Shutdown()
+	}
+	if apiServer != nil {
+		apiServer.Close()
+	}
+	if err := store.Close(); err != nil {
+		log.Println(err)
+	}
+	if err != nil {
+		os.Exit(1)
 	}
-	defer server.Shutdown()
 }
 
 // parseFlags parses command-line flags into an AppConfig.
@@ -56,8 +195,35 @@ func parseFlags() AppConfig {
 	var config AppConfig
 
 	flag.StringVar(&config.DefaultAnswer, "default-answer", "127.0.0.1", "Default answer for DNS queries")
-	flag.StringVar(&config.ListenAddress, "listen", ":53", "The address to listen on for DNS queries")
+	flag.StringVar(&config.ListenAddress, "listen", ":53", "The address to listen on for DNS queries (UDP and TCP)")
+	maxUDPSize := flag.Int("edns-size", 1232, "Maximum EDNS0 UDP payload size to advertise and send")
 	flag.BoolVar(&config.UseSourceIPAsAnswer, "use-source-ip", false, "Use source IP as answer")
+	zoneFiles := flag.String("zone-files", "", "Comma-separated list of RFC 1035 zone files to serve")
+	flag.StringVar(&config.RulesFile, "rules", "", "JSON file of wildcard/regex answer rules")
+	flag.StringVar(&config.ProbeZone, "probe-zone", "", "Zone suffix of forwarding-path probe names; enables probe decoding")
+	flag.StringVar(&config.ProbeEncoding, "probe-encoding", "plain", "Encoding of the target address in probe names: plain, dictionary or keyed")
+	flag.StringVar(&config.DictionaryFile, "dictionary", "dictionary.txt", "ipcipher dictionary file for dictionary encoding")
+	flag.StringVar(&config.ProbeKey, "probe-key", "", "ipcipher passphrase for keyed encoding")
+	flag.StringVar(&config.DBPath, "db", "./dns.db", "SQLite database file")
+	flag.IntVar(&config.BatchSize, "batch-size", 500, "Maximum number of log rows written per database transaction")
+	batchInterval := flag.Int("batch-interval", 1000, "Milliseconds between database writes of queued log rows")
+	flag.StringVar(&config.APIListen, "api-listen", "", "Loopback address for the HTTP management API, e.g. 127.0.0.1:8053 (disabled when empty)")
+	flag.StringVar(&config.APIToken, "api-token", os.Getenv("DNSAUTHSINK_API_TOKEN"), "Bearer token for the management API (default $DNSAUTHSINK_API_TOKEN)")
+	flag.StringVar(&config.CanaryWebhook, "canary-webhook", "", "URL that canary token alerts are POSTed to as JSON")
+	canaryDedup := flag.Int("canary-dedup", 60, "Seconds during which repeats of a canary query from the same source raise no new alert (0 disables)")
+	flag.StringVar(&config.ExfilZone, "exfil-zone", "", "Zone of exfiltration queries to reassemble; enables reassembly")
+	flag.StringVar(&config.ExfilEncoding, "exfil-encoding", "base32", "Encoding of exfiltrated data labels: base32 or hex")
+	flag.StringVar(&config.ExfilDir, "exfil-dir", "./exfil", "Directory reassembled payloads are written to")
+	exfilTimeout := flag.Int("exfil-timeout", 60, "Seconds without new chunks after which an incomplete session is written out")
+	allow := flag.String("allow", "", "Comma-separated CIDRs allowed to query (default: all)")
+	deny := flag.String("deny", "", "Comma-separated CIDRs whose queries are never answered")
+	flag.Float64Var(&config.Guard.SourceRate, "rrl-rate", 0, "UDP responses per second per source prefix (0 disables)")
+	flag.Float64Var(&config.Guard.QNameRate, "rrl-qname-rate", 0, "UDP responses per second per query name (0 disables)")
+	flag.IntVar(&config.Guard.IPv4Prefix, "rrl-ipv4-prefix", 24, "Prefix length grouping IPv4 sources for rate limiting")
+	flag.IntVar(&config.Guard.IPv6Prefix, "rrl-ipv6-prefix", 56, "Prefix length grouping IPv6 sources for rate limiting")
+	flag.IntVar(&config.Guard.Slip, "rrl-slip", 2, "Send every Nth rate limited UDP response truncated instead of dropping it (0 never)")
+	flag.Float64Var(&config.Guard.GlobalRate, "max-qps", 0, "Maximum responses per second in total (0 disables)")
+	reloadInterval := flag.Int("reload-interval", 5, "Seconds between checks for changed zone and rules files (0 disables)")
 
 	filenamePrefix := flag.String("filenamePrefix", "dnsauthoritysink", "Prefix for log filenames")
 	logDir := flag.String("logDir", "./logs", "Directory for log files")
@@ -66,6 +232,30 @@ func parseFlags() AppConfig {
 
 	flag.Parse()
 
+	if *zoneFiles != "" {
+		config.ZoneFiles = strings.Split(*zoneFiles, ",")
+	}
+	config.ReloadInterval = time.Duration(*reloadInterval) * time.Second
+	config.MaxUDPSize = uint16(*maxUDPSize)
+	config.BatchInterval = time.Duration(*batchInterval) * time.Millisecond
+	config.CanaryDedup = time.Duration(*canaryDedup) * time.Second
+	config.ExfilTimeout = time.Duration(*exfilTimeout) * time.Second
+
+	if *maxUDPSize < 512 || *maxUDPSize > 65535 {
+		log.Fatalf("Invalid -edns-size %d: must be between 512 and 65535", *maxUDPSize)
+	}
+	if config.BatchSize < 1 {
+		log.Fatalf("Invalid -batch-size %d: must be at least 1", config.BatchSize)
+	}
+
+	var err error
+	if config.Guard.Allow, err = parseCIDRList(*allow); err != nil {
+		log.Fatalf("Invalid -allow list: %v", err)
+	}
+	if config.Guard.Deny, err = parseCIDRList(*deny); err != nil {
+		log.Fatalf("Invalid -deny list: %v", err)
+	}
+
 	config.LoggerConfig = jsonllogger.LoggerConfig{
 		FilenamePrefix: *filenamePrefix,
 		LogDir:         *logDir,
@@ -76,96 +266,157 @@ func parseFlags() AppConfig {
 	return config
 }
 
-// initDB initializes and returns a new database connection.
-func initDB() (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", "./dns.db")
-	if err != nil {
-		return nil, err
-	}
-
-	createTableQuery := `CREATE TABLE IF NOT EXISTS dns_records (
-		id INTEGER PRIMARY KEY,
-		qname TEXT,
-		answer TEXT,
-		UNIQUE(qname)
-	);
-	CREATE TABLE IF NOT EXISTS dns_queries (
-		id INTEGER PRIMARY KEY,
-		source_ip TEXT,
-		qname TEXT,
-		timestamp DATETIME
-	);`
-
-	_, err = db.Exec(createTableQuery)
-	if err != nil {
-		return nil, err
+// setupDNSServer sets up and returns UDP and TCP DNS servers sharing the
+// listen address.
+func setupDNSServer(sink *Sink) []*dns.Server {
+	dns.HandleFunc(".", sink.handleRequest)
+	return []*dns.Server{
+		{Addr: sink.config.ListenAddress, Net: "udp"},
+		{Addr: sink.config.ListenAddress, Net: "tcp"},
 	}
-
-	return db, nil
-}
-
-// setupDNSServer sets up and returns a new DNS server.
-func setupDNSServer(config AppConfig, db *sql.DB, jsonLogger *jsonllogger.Logger) *dns.Server {
-	dns.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
-		handleRequest(w, r, db, jsonLogger, config)
-	})
-	server := &dns.Server{Addr: config.ListenAddress, Net: "udp"}
-	return server
 }
 
 // handleRequest handles incoming DNS requests.
-func handleRequest(w dns.ResponseWriter, r *dns.Msg, db *sql.DB, jsonLogger *jsonllogger.Logger, config AppConfig) {
+func (s *Sink) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 	m := new(dns.Msg)
 	m.SetReply(r)
 
-	ip, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	ip, port, err := net.SplitHostPort(w.RemoteAddr().String())
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	srcPort, _ := strconv.Atoi(port)
 
-	for _, q := range r.Question {
+	transport := "udp"
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		transport = "tcp"
+	}
+
+	opt := r.IsEdns0()
+	edns := parseEDNS(opt)
+	supported := true
+	if opt != nil {
+		supported = setReplyEDNS(m, opt, s.config.MaxUDPSize, net.ParseIP(ip))
+	}
+
+	action := ActionAnswer
+	if len(r.Question) > 0 {
+		action = s.guard.Check(net.ParseIP(ip), r.Question[0].Name, transport, time.Now())
+	}
 
-		answer := findAnswer(db, q.Name, ip, config.UseSourceIPAsAnswer, config.DefaultAnswer)
-		rr, err := dns.NewRR(fmt.Sprintf("%s A %s", q.Name, answer))
-		if err == nil {
-			m.Answer = append(m.Answer, rr)
+	answers := s.answers.Current()
+	responses := make([]string, len(r.Question))
+	if action == ActionAnswer && supported {
+		for i, q := range r.Question {
+			responses[i] = s.resolve(m, answers, q, ip)
 		}
-		logQuery(db, jsonLogger, ip, q.Name, answer, time.Now())
 	}
 
-	err = w.WriteMsg(m)
-	if err != nil {
-		log.Println(err)
+	// Rate limited queries are still logged below, and slipped ones receive an
+	// empty truncated response so that genuine clients retry over TCP.
+	rcode := ""
+	if action == ActionAnswer || action == ActionSlip {
+		m.Truncated = action == ActionSlip
+		m.Truncate(maxResponseSize(transport, opt, s.config.MaxUDPSize))
+		err = w.WriteMsg(m)
+		if err != nil {
+			log.Println(err)
+		}
+		rcode = dns.RcodeToString[m.Rcode]
+	}
+
+	timestamp := time.Now()
+	for i, q := range r.Question {
+		s.stats.Record(strings.ToLower(q.Name), ip, timestamp)
+		dnsQuery := DNSQuery{
+			SourceIP:         ip,
+			SourcePort:       srcPort,
+			Transport:        transport,
+			ID:               r.Id,
+			Query:            q.Name,
+			QType:            dns.TypeToString[q.Qtype],
+			QClass:           dns.ClassToString[q.Qclass],
+			CasePattern:      casePattern(q.Name),
+			RecursionDesired: r.RecursionDesired,
+			CheckingDisabled: r.CheckingDisabled,
+			DO:               edns != nil && edns.DO,
+			QuerySize:        r.Len(),
+			Rcode:            rcode,
+			Action:           action,
+			Answer:           responses[i],
+			Timestamp:        timestamp,
+			EDNS:             edns,
+		}
+		logQuery(s.store, s.jsonLogger, dnsQuery)
+
+		if alert, ok := s.canaries.Match(dnsQuery); ok {
+			s.canaries.Raise(alert, s.jsonLogger)
+		}
+
+		if s.exfil != nil {
+			s.exfil.Add(dnsQuery)
+		}
+
+		if s.probes != nil {
+			if path, ok := decodeForwardingPath(s.probes, dnsQuery); ok {
+				s.logForwardingPath(path)
+			}
+		}
 	}
 }
 
-// logQuery logs a DNS query to the database and JSON logger.
-func logQuery(db *sql.DB, jsonLogger *jsonllogger.Logger, srcIP, qname string, answer string, timestamp time.Time) {
-	dnsQuery := DNSQuery{
-		SourceIP:  srcIP,
-		Query:     qname,
-		Answer:    answer,
-		Timestamp: timestamp,
+// resolve adds the answer to q to m and returns a textual summary of it.
+// Rules are consulted first, then the loaded zones, and finally the
+// dns_records table and default answer.
+func (s *Sink) resolve(m *dns.Msg, answers *AnswerSet, q dns.Question, ip string) string {
+	srcIP := net.ParseIP(ip)
+	for _, rule := range answers.Rules {
+		match, ok := rule.match(q, srcIP)
+		if !ok {
+			continue
+		}
+		if !rule.answers(q.Qtype) {
+			// NODATA: the name exists but has no records of this type.
+			m.Authoritative = true
+			return ""
+		}
+		rrs, err := rule.answer(match)
+		if err != nil {
+			log.Printf("Rule %s failed for %s: %v", rule.Name, q.Name, err)
+			m.Rcode = dns.RcodeServerFailure
+			return ""
+		}
+		m.Authoritative = true
+		m.Rcode = rule.rcode
+		m.Answer = append(m.Answer, rrs...)
+		return dnsrecord.RdataString(rrs)
 	}
-	jsonLogger.Log(dnsQuery)
 
-	query := `INSERT INTO dns_queries (source_ip, qname, timestamp) VALUES (?, ?, ?)`
-	_, err := db.Exec(query, srcIP, qname, timestamp)
-	if err != nil {
-		log.Println(err)
+	if result, ok := answers.Zones.Lookup(q.Name, q.Qtype); ok {
+		m.Authoritative = true
+		m.Rcode = result.Rcode
+		m.Answer = append(m.Answer, result.Answer...)
+		m.Ns = append(m.Ns, result.Ns...)
+		return dnsrecord.RdataString(result.Answer)
 	}
+
+	answer := findAnswer(s.store, q.Name, ip, s.config.UseSourceIPAsAnswer, s.config.DefaultAnswer)
+	rr, err := dns.NewRR(fmt.Sprintf("%s A %s", q.Name, answer))
+	if err == nil {
+		m.Answer = append(m.Answer, rr)
+	}
+	return answer
 }
 
 // findAnswer finds the DNS answer for a given query name.
-func findAnswer(db *sql.DB, qname, srcIP string, useSrcIP bool, defaultAnswer string) string {
+func findAnswer(store *Store, qname, srcIP string, useSrcIP bool, defaultAnswer string) string {
 	if useSrcIP {
 		return srcIP
 	}
 
-	var answer string
-	err := db.QueryRow("SELECT answer FROM dns_records WHERE qname = ?", qname).Scan(&answer)
-	if err != nil {
+	answer, ok := store.FindAnswer(qname)
+	if !ok {
 		return defaultAnswer
 	}
 
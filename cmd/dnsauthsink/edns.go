@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// EDNSInfo holds the EDNS0 details of a query.
+type EDNSInfo struct {
+	Version      uint8
+	UDPSize      uint16
+	DO           bool
+	ClientSubnet string // network announced in the client subnet option
+	SubnetScope  uint8
+	ClientCookie string
+	ServerCookie string
+	Options      []string // names of every option present
+}
+
+// cookieSecret keys the server cookies handed out to clients.
+var cookieSecret = func() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}()
+
+// parseEDNS extracts the EDNS0 details from a query's OPT record.
+func parseEDNS(opt *dns.OPT) *EDNSInfo {
+	if opt == nil {
+		return nil
+	}
+
+	info := &EDNSInfo{
+		Version: opt.Version(),
+		UDPSize: opt.UDPSize(),
+		DO:      opt.Do(),
+	}
+	for _, option := range opt.Option {
+		info.Options = append(info.Options, ednsOptionName(option.Option()))
+		switch o := option.(type) {
+		case *dns.EDNS0_SUBNET:
+			info.ClientSubnet = clientSubnet(o)
+			info.SubnetScope = o.SourceScope
+		case *dns.EDNS0_COOKIE:
+			if len(o.Cookie) >= 16 {
+				info.ClientCookie = o.Cookie[:16]
+				info.ServerCookie = o.Cookie[16:]
+			}
+		}
+	}
+	return info
+}
+
+// clientSubnet formats the network announced in a client subnet option.
+func clientSubnet(o *dns.EDNS0_SUBNET) string {
+	ip, bits := o.Address.To16(), 128
+	if o.Family == 1 {
+		ip, bits = o.Address.To4(), 32
+	}
+	if ip == nil {
+		return ""
+	}
+	ipnet := net.IPNet{IP: ip, Mask: net.CIDRMask(int(o.SourceNetmask), bits)}
+	return ipnet.String()
+}
+
+// ednsOptionName returns the mnemonic of an EDNS0 option code.
+func ednsOptionName(code uint16) string {
+	switch code {
+	case dns.EDNS0NSID:
+		return "NSID"
+	case dns.EDNS0SUBNET:
+		return "ECS"
+	case dns.EDNS0COOKIE:
+		return "COOKIE"
+	case dns.EDNS0TCPKEEPALIVE:
+		return "TCP-KEEPALIVE"
+	case dns.EDNS0PADDING:
+		return "PADDING"
+	case dns.EDNS0EXPIRE:
+		return "EXPIRE"
+	case dns.EDNS0DAU:
+		return "DAU"
+	case dns.EDNS0DHU:
+		return "DHU"
+	case dns.EDNS0N3U:
+		return "N3U"
+	case dns.EDNS0EDE:
+		return "EDE"
+	}
+	return fmt.Sprintf("OPT%d", code)
+}
+
+// setReplyEDNS adds an OPT record to the reply m for a query carrying opt.
+// The client subnet option is echoed back with a scope of zero, and the client
+// cookie is returned together with a server cookie derived from the client
+// address. It returns false when the query uses an unsupported EDNS version.
+func setReplyEDNS(m *dns.Msg, opt *dns.OPT, maxUDPSize uint16, srcIP net.IP) bool {
+	size := opt.UDPSize()
+	if size > maxUDPSize {
+		size = maxUDPSize
+	}
+	m.SetEdns0(size, opt.Do())
+	reply := m.IsEdns0()
+
+	if opt.Version() != 0 {
+		m.Rcode = dns.RcodeBadVers
+		return false
+	}
+
+	for _, option := range opt.Option {
+		switch o := option.(type) {
+		case *dns.EDNS0_SUBNET:
+			reply.Option = append(reply.Option, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        o.Family,
+				SourceNetmask: o.SourceNetmask,
+				SourceScope:   0,
+				Address:       o.Address,
+			})
+		case *dns.EDNS0_COOKIE:
+			if len(o.Cookie) < 16 {
+				continue
+			}
+			clientCookie := o.Cookie[:16]
+			reply.Option = append(reply.Option, &dns.EDNS0_COOKIE{
+				Code:   dns.EDNS0COOKIE,
+				Cookie: clientCookie + serverCookie(clientCookie, srcIP),
+			})
+		}
+	}
+	return true
+}
+
+// serverCookie returns the hex encoded server cookie for a client cookie and
+// client address.
+func serverCookie(clientCookie string, srcIP net.IP) string {
+	mac := hmac.New(sha256.New, cookieSecret)
+	mac.Write([]byte(clientCookie))
+	mac.Write(srcIP)
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// maxResponseSize returns the largest response the client can accept over
+// the given transport.
+func maxResponseSize(transport string, opt *dns.OPT, maxUDPSize uint16) int {
+	if transport == "tcp" {
+		return dns.MaxMsgSize
+	}
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+	size := opt.UDPSize()
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	if size > maxUDPSize {
+		size = maxUDPSize
+	}
+	return int(size)
+}
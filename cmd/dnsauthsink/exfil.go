@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsonllogger "github.com/clwg/netsecutils/pkg/logging"
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxExfilSessions bounds the number of sessions being reassembled.
+	maxExfilSessions = 10000
+	// maxExfilChunks bounds the number of chunks in a session.
+	maxExfilChunks = 65536
+)
+
+// exfilLabelPattern matches the session label, and exfilSeqPattern the
+// "<seq>-<total>" sequence label, of an exfiltration query name.
+var (
+	exfilLabelPattern = regexp.MustCompile(`^[a-z0-9]{1,32}$`)
+	exfilSeqPattern   = regexp.MustCompile(`^([0-9]{1,5})-([0-9]{1,5})$`)
+)
+
+// ExfilSession is the metadata written alongside a reassembled payload.
+type ExfilSession struct {
+	Event      string
+	Session    string
+	SourceIP   string
+	Encoding   string
+	Complete   bool
+	Chunks     int
+	Received   int
+	Missing    []int `json:",omitempty"`
+	Duplicates int
+	Bytes      int
+	SHA256     string
+	FirstSeen  time.Time
+	LastSeen   time.Time
+	File       string
+
+	data map[int][]byte
+}
+
+// ExfilCollector reassembles payloads sent as chunks in query names of the
+// form <data>[.<data>...].<seq>-<total>.<session>.<zone>, where the data
+// labels hold base32 or hex encoded bytes and seq counts from zero.
+// Sessions are tracked per source address and written to dir once all
+// chunks have arrived, or as incomplete after timeout without new chunks.
+type ExfilCollector struct {
+	zone       string
+	encoding   string
+	dir        string
+	timeout    time.Duration
+	jsonLogger *jsonllogger.Logger
+
+	mu       sync.Mutex
+	sessions map[string]*ExfilSession
+}
+
+// newExfilCollector returns a collector for names under zone.
+func newExfilCollector(zone, encoding, dir string, timeout time.Duration, jsonLogger *jsonllogger.Logger) (*ExfilCollector, error) {
+	if encoding != "base32" && encoding != "hex" {
+		return nil, fmt.Errorf("unknown exfil encoding %q", encoding)
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("exfil timeout must be positive, got %v", timeout)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	c := &ExfilCollector{
+		zone:       strings.ToLower(dns.Fqdn(zone)),
+		encoding:   encoding,
+		dir:        dir,
+		timeout:    timeout,
+		jsonLogger: jsonLogger,
+		sessions:   make(map[string]*ExfilSession),
+	}
+	go c.expire()
+	return c, nil
+}
+
+// Add records the chunk carried by a query, if any.
+func (c *ExfilCollector) Add(q DNSQuery) {
+	name := strings.ToLower(q.Query)
+	if !dns.IsSubDomain(c.zone, name) {
+		return
+	}
+
+	labels := dns.SplitDomainName(strings.TrimSuffix(name, c.zone))
+	if len(labels) < 3 {
+		return
+	}
+	n := len(labels)
+	session, seqLabel := labels[n-1], labels[n-2]
+
+	groups := exfilSeqPattern.FindStringSubmatch(seqLabel)
+	if groups == nil || !exfilLabelPattern.MatchString(session) {
+		return
+	}
+	seq, _ := strconv.Atoi(groups[1])
+	total, _ := strconv.Atoi(groups[2])
+	if total < 1 || total > maxExfilChunks || seq >= total {
+		return
+	}
+
+	chunk, err := c.decode(strings.Join(labels[:n-2], ""))
+	if err != nil {
+		return
+	}
+
+	if s := c.add(q, session, seq, total, chunk); s != nil {
+		c.write(s)
+	}
+}
+
+// add stores a chunk of a session and returns the session once all of its
+// chunks have arrived.
+func (c *ExfilCollector) add(q DNSQuery, session string, seq, total int, chunk []byte) *ExfilSession {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := q.SourceIP + "|" + session
+	s, ok := c.sessions[key]
+	if !ok {
+		if len(c.sessions) >= maxExfilSessions {
+			return nil
+		}
+		s = &ExfilSession{
+			Event:     "exfil_session",
+			Session:   session,
+			SourceIP:  q.SourceIP,
+			Encoding:  c.encoding,
+			Chunks:    total,
+			FirstSeen: q.Timestamp,
+			data:      make(map[int][]byte),
+		}
+		c.sessions[key] = s
+	}
+	if total != s.Chunks {
+		return nil
+	}
+
+	s.LastSeen = q.Timestamp
+	if _, ok := s.data[seq]; ok {
+		// Resolvers retry, so repeated chunks are expected.
+		s.Duplicates++
+		return nil
+	}
+	s.data[seq] = chunk
+
+	if len(s.data) < s.Chunks {
+		return nil
+	}
+	delete(c.sessions, key)
+	return s
+}
+
+// decode converts the joined data labels to bytes.
+func (c *ExfilCollector) decode(data string) ([]byte, error) {
+	if c.encoding == "hex" {
+		return hex.DecodeString(data)
+	}
+	return labelEncoding.DecodeString(strings.ToUpper(data))
+}
+
+// expire periodically writes out the expired sessions.
+func (c *ExfilCollector) expire() {
+	for now := range time.Tick(c.timeout / 2) {
+		for _, s := range c.expired(now) {
+			c.write(s)
+		}
+	}
+}
+
+// expired removes and returns the sessions that have not received a chunk
+// within the timeout before now.
+func (c *ExfilCollector) expired(now time.Time) []*ExfilSession {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var expired []*ExfilSession
+	for key, s := range c.sessions {
+		if now.Sub(s.LastSeen) >= c.timeout {
+			delete(c.sessions, key)
+			expired = append(expired, s)
+		}
+	}
+	return expired
+}
+
+// write saves the payload and its metadata. Missing chunks of an incomplete
+// session are left out of the payload and listed in the metadata.
+func (c *ExfilCollector) write(s *ExfilSession) {
+	var payload []byte
+	for seq := 0; seq < s.Chunks; seq++ {
+		chunk, ok := s.data[seq]
+		if !ok {
+			s.Missing = append(s.Missing, seq)
+			continue
+		}
+		payload = append(payload, chunk...)
+	}
+	sort.Ints(s.Missing)
+
+	s.Received = len(s.data)
+	s.Complete = len(s.Missing) == 0
+	s.Bytes = len(payload)
+	sum := sha256.Sum256(payload)
+	s.SHA256 = hex.EncodeToString(sum[:])
+
+	base := fmt.Sprintf("%s-%s-%s", s.FirstSeen.UTC().Format("20060102T150405Z"), strings.NewReplacer(":", "_", ".", "_").Replace(s.SourceIP), s.Session)
+	s.File = filepath.Join(c.dir, base+".bin")
+
+	if err := os.WriteFile(s.File, payload, 0o600); err != nil {
+		log.Printf("Failed to write exfil payload: %v", err)
+		return
+	}
+	meta, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(c.dir, base+".json"), meta, 0o600); err != nil {
+		log.Printf("Failed to write exfil metadata: %v", err)
+	}
+
+	c.jsonLogger.Log(s)
+	log.Printf("Exfil session %s from %s: %d of %d chunks, %d bytes written to %s", s.Session, s.SourceIP, s.Received, s.Chunks, s.Bytes, s.File)
+}
+
+// runExfil implements the exfil subcommand, a client that sends a file to a
+// dnsauthsink as exfiltration queries for testing the collector and DLP
+// detections.
+func runExfil(args []string) {
+	fs := flag.NewFlagSet("exfil", flag.ExitOnError)
+	server := fs.String("server", "127.0.0.1:53", "Address of the DNS server to send queries to")
+	zone := fs.String("zone", "", "Exfiltration zone, matching the sink's -exfil-zone")
+	file := fs.String("file", "", "File to send (default stdin)")
+	session := fs.String("session", "", "Session label (default random)")
+	encoding := fs.String("encoding", "base32", "Encoding of the data labels: base32 or hex")
+	delay := fs.Int("delay", 0, "Milliseconds to wait between queries")
+	tcp := fs.Bool("tcp", false, "Query over TCP instead of UDP")
+	timeout := fs.Int("timeout", 2000, "Query timeout in milliseconds")
+	fs.Parse(args)
+
+	if *zone == "" {
+		fmt.Fprintln(os.Stderr, "exfil: -zone is required")
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *session == "" {
+		*session = fmt.Sprintf("%08x", time.Now().UnixNano()&0xffffffff)
+	}
+	if !exfilLabelPattern.MatchString(*session) {
+		log.Fatalf("Session label must be 1 to 32 lower case letters and digits")
+	}
+
+	var data []byte
+	var err error
+	if *file == "" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(*file)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(data) == 0 {
+		log.Fatal("Nothing to send")
+	}
+
+	names, err := exfilNames(data, *session, dns.Fqdn(*zone), *encoding)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client := &dns.Client{Timeout: time.Duration(*timeout) * time.Millisecond}
+	if *tcp {
+		client.Net = "tcp"
+	}
+
+	failed := 0
+	for i, name := range names {
+		if i > 0 && *delay > 0 {
+			time.Sleep(time.Duration(*delay) * time.Millisecond)
+		}
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		if _, _, err := client.Exchange(msg, *server); err != nil {
+			failed++
+		}
+	}
+	fmt.Printf("Sent %d bytes in %d queries as session %s (%d failed)\n", len(data), len(names), *session, failed)
+}
+
+// exfilNames splits data into query names that each fit the 253 character
+// limit of a domain name.
+func exfilNames(data []byte, session, zone, encoding string) ([]string, error) {
+	var encode func([]byte) string
+	var encodedLen func(int) int
+	switch encoding {
+	case "base32":
+		encode = func(b []byte) string { return strings.ToLower(labelEncoding.EncodeToString(b)) }
+		encodedLen = labelEncoding.EncodedLen
+	case "hex":
+		encode = hex.EncodeToString
+		encodedLen = hex.EncodedLen
+	default:
+		return nil, fmt.Errorf("unknown exfil encoding %q", encoding)
+	}
+
+	// Reserve room for the widest possible sequence label.
+	digits := len(strconv.Itoa(len(data) + 1))
+	room := 253 - len(zone) - len(session) - 1 - (2*digits + 2)
+
+	// Each 63 character label costs one more character for its dot.
+	chunkSize := 0
+	for n := 1; ; n++ {
+		chars := encodedLen(n)
+		if chars+(chars+62)/63 > room {
+			break
+		}
+		chunkSize = n
+	}
+	if chunkSize == 0 {
+		return nil, fmt.Errorf("zone %s leaves no room for data", zone)
+	}
+
+	total := (len(data) + chunkSize - 1) / chunkSize
+	if total > maxExfilChunks {
+		return nil, fmt.Errorf("%d bytes need %d chunks, at most %d are supported", len(data), total, maxExfilChunks)
+	}
+
+	names := make([]string, 0, total)
+	for seq := 0; seq < total; seq++ {
+		end := (seq + 1) * chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		encoded := encode(data[seq*chunkSize : end])
+
+		var labels []string
+		for len(encoded) > 63 {
+			labels = append(labels, encoded[:63])
+			encoded = encoded[63:]
+		}
+		labels = append(labels, encoded)
+		names = append(names, fmt.Sprintf("%s.%d-%d.%s.%s", strings.Join(labels, "."), seq, total, session, zone))
+	}
+	return names, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	jsonllogger "github.com/clwg/netsecutils/pkg/logging"
+)
+
+// newTestCollector returns a collector for exfil.example.com writing to a
+// temporary directory.
+func newTestCollector(t *testing.T, encoding string) *ExfilCollector {
+	t.Helper()
+	dir := t.TempDir()
+	logger, err := jsonllogger.NewLogger(jsonllogger.LoggerConfig{
+		LogDir:         filepath.Join(dir, "logs"),
+		FilenamePrefix: "test",
+		MaxLines:       1000,
+		RotationTime:   time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newExfilCollector("exfil.example.com", encoding, filepath.Join(dir, "exfil"), time.Hour, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// readSession returns the only payload written by c and its metadata.
+func readSession(t *testing.T, c *ExfilCollector) ([]byte, ExfilSession) {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("got %d sessions written, want 1", len(files))
+	}
+	meta, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s ExfilSession
+	if err := json.Unmarshal(meta, &s); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := os.ReadFile(strings.TrimSuffix(files[0], ".json") + ".bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload, s
+}
+
+func TestExfilReassemblesOutOfOrderAndDuplicateChunks(t *testing.T) {
+	for _, encoding := range []string{"base32", "hex"} {
+		t.Run(encoding, func(t *testing.T) {
+			c := newTestCollector(t, encoding)
+			data := bytes.Repeat([]byte("exfiltrated payload \x00\xff "), 40)
+			names, err := exfilNames(data, "s1", c.zone, encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) < 3 {
+				t.Fatalf("got %d chunks, want at least 3", len(names))
+			}
+
+			// Last chunk first, then the rest in reverse, each preceded by
+			// a repeat of the chunk before and followed by a query of
+			// another source.
+			start := time.Now()
+			send := func(name, source string) {
+				c.Add(DNSQuery{SourceIP: source, Query: strings.ToUpper(name), Timestamp: start})
+			}
+			send(names[len(names)-1], "192.0.2.1")
+			for i := len(names) - 2; i >= 0; i-- {
+				send(names[i+1], "192.0.2.1")
+				send(names[i], "192.0.2.1")
+				send(names[i], "192.0.2.2")
+			}
+
+			payload, s := readSession(t, c)
+			if !bytes.Equal(payload, data) {
+				t.Errorf("payload = %q, want %q", payload, data)
+			}
+			if !s.Complete || s.Received != len(names) || s.Chunks != len(names) || len(s.Missing) != 0 {
+				t.Errorf("session = %+v, want complete with %d chunks", s, len(names))
+			}
+			if want := len(names) - 1; s.Duplicates != want {
+				t.Errorf("duplicates = %d, want %d", s.Duplicates, want)
+			}
+			if s.SourceIP != "192.0.2.1" || s.Bytes != len(data) {
+				t.Errorf("session = %+v", s)
+			}
+
+			// The other source's session stays incomplete.
+			c.mu.Lock()
+			pending := len(c.sessions)
+			c.mu.Unlock()
+			if pending != 1 {
+				t.Errorf("got %d pending sessions, want 1", pending)
+			}
+		})
+	}
+}
+
+func TestExfilWritesExpiredIncompleteSession(t *testing.T) {
+	c := newTestCollector(t, "base32")
+	data := bytes.Repeat([]byte("0123456789"), 50)
+	names, err := exfilNames(data, "s2", c.zone, "base32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for i, name := range names {
+		if i == 1 {
+			continue
+		}
+		c.Add(DNSQuery{SourceIP: "2001:db8::1", Query: name, Timestamp: start})
+	}
+	if expired := c.expired(start.Add(c.timeout - time.Second)); len(expired) != 0 {
+		t.Fatalf("got %d sessions expired before the timeout", len(expired))
+	}
+	for _, s := range c.expired(start.Add(c.timeout)) {
+		c.write(s)
+	}
+
+	payload, s := readSession(t, c)
+	if s.Complete || len(s.Missing) != 1 || s.Missing[0] != 1 || s.Received != len(names)-1 {
+		t.Errorf("session = %+v, want chunk 1 missing", s)
+	}
+	size := len(data) - len(payload)
+	if size <= 0 || !bytes.Equal(payload, append(data[:size:size], data[2*size:]...)) {
+		t.Errorf("payload of %d bytes is not the data without chunk 1", len(payload))
+	}
+}
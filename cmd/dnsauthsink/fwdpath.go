@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/clwg/netsecutils/pkg/probename"
+)
+
+// ForwardingPath links the target address encoded in a probe name to the
+// resolver that forwarded the query to us.
+type ForwardingPath struct {
+	Timestamp      time.Time
+	Query          string
+	Target         string // address the probe was sent to
+	EgressResolver string // address the query arrived from
+	EgressPort     int
+	ClientSubnet   string
+	ScanID         string     `json:",omitempty"` // scan run encoded in the probe name
+	ProbeTime      *time.Time `json:",omitempty"`
+	LatencyMs      *int64     `json:",omitempty"` // time between probe and arrival
+}
+
+const createForwardingPathsTable = `CREATE TABLE IF NOT EXISTS forwarding_paths (
+	id INTEGER PRIMARY KEY,
+	timestamp DATETIME,
+	qname TEXT,
+	target TEXT,
+	egress_resolver TEXT,
+	egress_port INTEGER,
+	client_subnet TEXT,
+	probe_time DATETIME,
+	latency_ms INTEGER,
+	scan_id TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_forwarding_paths_target ON forwarding_paths (target);`
+
+// forwardingPathColumns are the forwarding_paths columns added since the
+// table was introduced.
+var forwardingPathColumns = [][2]string{
+	{"scan_id", "TEXT"},
+}
+
+const insertForwardingPathStatement = `INSERT INTO forwarding_paths (
+	timestamp, qname, target, egress_resolver, egress_port, client_subnet, probe_time, latency_ms, scan_id
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// decodeForwardingPath returns the forwarding path revealed by a query, or
+// false when the query name is not a probe name.
+func decodeForwardingPath(codec *probename.Codec, q DNSQuery) (ForwardingPath, bool) {
+	probe, err := codec.Decode(q.Query)
+	if err != nil {
+		return ForwardingPath{}, false
+	}
+
+	path := ForwardingPath{
+		Timestamp:      q.Timestamp,
+		Query:          q.Query,
+		Target:         probe.Target.String(),
+		EgressResolver: q.SourceIP,
+		EgressPort:     q.SourcePort,
+		ScanID:         probe.Scan,
+	}
+	if q.EDNS != nil {
+		path.ClientSubnet = q.EDNS.ClientSubnet
+	}
+	if !probe.Timestamp.IsZero() {
+		latency := q.Timestamp.Sub(probe.Timestamp).Milliseconds()
+		path.ProbeTime = &probe.Timestamp
+		path.LatencyMs = &latency
+	}
+	return path, true
+}
+
+// logForwardingPath logs a forwarding path to the database and JSON logger.
+func (s *Sink) logForwardingPath(path ForwardingPath) {
+	s.jsonLogger.Log(path)
+	s.store.LogForwardingPath(path)
+}
+
+// forwardingPathArgs returns the insertForwardingPathStatement arguments for
+// a forwarding path.
+func forwardingPathArgs(path ForwardingPath) []interface{} {
+	var probeTime sql.NullTime
+	var latency sql.NullInt64
+	if path.ProbeTime != nil {
+		probeTime = sql.NullTime{Time: *path.ProbeTime, Valid: true}
+		latency = sql.NullInt64{Int64: *path.LatencyMs, Valid: true}
+	}
+
+	return []interface{}{
+		path.Timestamp, path.Query, path.Target, path.EgressResolver, path.EgressPort,
+		nullString(path.ClientSubnet), probeTime, latency, nullString(path.ScanID),
+	}
+}
+
+// newProbeCodec returns the probe name codec configured by the flags, or nil
+// when forwarding-path decoding is disabled.
+func newProbeCodec(config AppConfig) (*probename.Codec, error) {
+	if config.ProbeZone == "" {
+		return nil, nil
+	}
+	encoding, err := probename.ParseEncoding(config.ProbeEncoding)
+	if err != nil {
+		return nil, err
+	}
+	return probename.NewCodec(config.ProbeZone, encoding, config.DictionaryFile, config.ProbeKey)
+}
+
+// nullString maps an empty string to SQL NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
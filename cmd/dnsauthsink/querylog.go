@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+
+	jsonllogger "github.com/clwg/netsecutils/pkg/logging"
+)
+
+// queryColumns are the dns_queries columns added after the original
+// source_ip, qname and timestamp columns.
+var queryColumns = [][2]string{
+	{"source_port", "INTEGER"},
+	{"transport", "TEXT"},
+	{"query_id", "INTEGER"},
+	{"qtype", "TEXT"},
+	{"qclass", "TEXT"},
+	{"case_pattern", "TEXT"},
+	{"rd", "INTEGER"},
+	{"cd", "INTEGER"},
+	{"do", "INTEGER"},
+	{"query_size", "INTEGER"},
+	{"rcode", "TEXT"},
+	{"answer", "TEXT"},
+	{"edns_version", "INTEGER"},
+	{"edns_udp_size", "INTEGER"},
+	{"edns_options", "TEXT"},
+	{"client_subnet", "TEXT"},
+	{"client_cookie", "TEXT"},
+	{"server_cookie", "TEXT"},
+	{"action", "TEXT"},
+}
+
+const insertQueryStatement = `INSERT INTO dns_queries (
+	source_ip, qname, timestamp, source_port, transport, query_id, qtype, qclass,
+	case_pattern, rd, cd, do, query_size, rcode, answer, edns_version,
+	edns_udp_size, edns_options, client_subnet, client_cookie, server_cookie, action
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// logQuery logs a DNS query to the database and JSON logger.
+func logQuery(store *Store, jsonLogger *jsonllogger.Logger, q DNSQuery) {
+	jsonLogger.Log(q)
+	store.LogQuery(q)
+}
+
+// queryArgs returns the insertQueryStatement arguments for a query.
+func queryArgs(q DNSQuery) []interface{} {
+	var ednsVersion, ednsUDPSize sql.NullInt64
+	var ednsOptions, clientSubnet, clientCookie, serverCookie sql.NullString
+	if q.EDNS != nil {
+		ednsVersion = sql.NullInt64{Int64: int64(q.EDNS.Version), Valid: true}
+		ednsUDPSize = sql.NullInt64{Int64: int64(q.EDNS.UDPSize), Valid: true}
+		ednsOptions = sql.NullString{String: strings.Join(q.EDNS.Options, ","), Valid: true}
+		clientSubnet = nullString(q.EDNS.ClientSubnet)
+		clientCookie = nullString(q.EDNS.ClientCookie)
+		serverCookie = nullString(q.EDNS.ServerCookie)
+	}
+
+	return []interface{}{
+		q.SourceIP, q.Query, q.Timestamp, q.SourcePort, q.Transport, q.ID, q.QType, q.QClass,
+		q.CasePattern, q.RecursionDesired, q.CheckingDisabled, q.DO, q.QuerySize, q.Rcode, q.Answer, ednsVersion,
+		ednsUDPSize, ednsOptions, clientSubnet, clientCookie, serverCookie, q.Action,
+	}
+}
+
+// casePattern describes the letter case of a query name as randomised by
+// resolvers using 0x20 encoding: "U" for upper case letters, "l" for lower case
+// letters, "." for label separators and "-" for anything else.
+func casePattern(qname string) string {
+	var b strings.Builder
+	b.Grow(len(qname))
+	for _, c := range qname {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			b.WriteByte('U')
+		case c >= 'a' && c <= 'z':
+			b.WriteByte('l')
+		case c == '.':
+			b.WriteByte('.')
+		default:
+			b.WriteByte('-')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Actions taken on a query by the Guard.
+const (
+	ActionAnswer = "answer" // answered normally
+	ActionSlip   = "slip"   // rate limited, answered with an empty truncated response
+	ActionDrop   = "drop"   // rate limited, no response sent
+	ActionDeny   = "deny"   // source not permitted, no response sent
+)
+
+// GuardConfig configures access control and response rate limiting.
+type GuardConfig struct {
+	Allow      []*net.IPNet // sources allowed to query, all when empty
+	Deny       []*net.IPNet // sources never answered
+	SourceRate float64      // responses per second per source prefix, 0 disables
+	QNameRate  float64      // responses per second per query name, 0 disables
+	GlobalRate float64      // responses per second in total, 0 disables
+	IPv4Prefix int          // prefix length grouping IPv4 sources
+	IPv6Prefix int          // prefix length grouping IPv6 sources
+	Slip       int          // every Slip-th rate limited UDP response is sent truncated, 0 never
+}
+
+// Guard decides whether a query is answered. Rate limits apply to UDP
+// responses, which can be reflected towards spoofed sources, while the global
+// cap and the access lists apply to every transport.
+type Guard struct {
+	config  GuardConfig
+	sources *RateLimiter
+	qnames  *RateLimiter
+	global  *RateLimiter
+	limited atomic.Int64
+}
+
+// newGuard returns a Guard for the given configuration.
+func newGuard(config GuardConfig) *Guard {
+	return &Guard{
+		config:  config,
+		sources: newRateLimiter(config.SourceRate),
+		qnames:  newRateLimiter(config.QNameRate),
+		global:  newRateLimiter(config.GlobalRate),
+	}
+}
+
+// Check returns the action to take for a query from srcIP for qname.
+func (g *Guard) Check(srcIP net.IP, qname, transport string, now time.Time) string {
+	if containsIP(g.config.Deny, srcIP) {
+		return ActionDeny
+	}
+	if len(g.config.Allow) > 0 && !containsIP(g.config.Allow, srcIP) {
+		return ActionDeny
+	}
+
+	if !g.global.Allow("", now) {
+		return ActionDrop
+	}
+	if transport != "udp" {
+		return ActionAnswer
+	}
+
+	sourceOK := g.sources.Allow(g.sourcePrefix(srcIP), now)
+	qnameOK := g.qnames.Allow(strings.ToLower(qname), now)
+	if sourceOK && qnameOK {
+		return ActionAnswer
+	}
+
+	if g.config.Slip > 0 && g.limited.Add(1)%int64(g.config.Slip) == 0 {
+		return ActionSlip
+	}
+	return ActionDrop
+}
+
+// sourcePrefix returns the network srcIP is rate limited as part of.
+func (g *Guard) sourcePrefix(srcIP net.IP) string {
+	if v4 := srcIP.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(g.config.IPv4Prefix, 32)).String()
+	}
+	return srcIP.Mask(net.CIDRMask(g.config.IPv6Prefix, 128)).String()
+}
+
+// RateLimiter is a set of token buckets, one per key, each refilling at rate
+// tokens per second with a burst of one second's worth of tokens (at least one).
+type RateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// tokenBucket is the state of a single key.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter allowing rate events per second per key.
+// A rate of zero allows everything.
+func newRateLimiter(rate float64) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   math.Max(rate, 1),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token from the bucket for key, reporting whether one was
+// available.
+func (l *RateLimiter) Allow(key string, now time.Time) bool {
+	if l.rate <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// sweep removes buckets that have refilled completely, bounding memory use
+// when many distinct keys are seen.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < 10*time.Second {
+		return
+	}
+	l.lastSweep = now
+
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// parseCIDRList parses a comma-separated list of CIDRs or single addresses.
+func parseCIDRList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// containsIP reports whether any of the networks contains ip.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Record is a row of the dns_records table.
+type Record struct {
+	ID     int64  `json:"id"`
+	QName  string `json:"qname"`
+	Answer string `json:"answer"`
+}
+
+// QueryRow is a row of the dns_queries table as returned by the management API.
+type QueryRow struct {
+	ID           int64     `json:"id"`
+	Timestamp    time.Time `json:"timestamp"`
+	SourceIP     string    `json:"source_ip"`
+	SourcePort   int64     `json:"source_port"`
+	Transport    string    `json:"transport"`
+	QName        string    `json:"qname"`
+	QType        string    `json:"qtype"`
+	Rcode        string    `json:"rcode"`
+	Answer       string    `json:"answer"`
+	ClientSubnet string    `json:"client_subnet"`
+	Action       string    `json:"action"`
+}
+
+// QueryFilter selects rows of the dns_queries table.
+type QueryFilter struct {
+	QName    string // exact query name, case-insensitive
+	Suffix   string // query names ending in this suffix
+	SourceIP string
+	QType    string
+	Action   string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+// ListRecords returns every dns_records row.
+func (s *Store) ListRecords() ([]Record, error) {
+	rows, err := s.db.Query("SELECT id, qname, answer FROM dns_records ORDER BY qname")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []Record{}
+	for rows.Next() {
+		var r Record
+		if err := rows.Scan(&r.ID, &r.QName, &r.Answer); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// GetRecord returns the dns_records row with the given id.
+func (s *Store) GetRecord(id int64) (Record, error) {
+	r := Record{ID: id}
+	err := s.db.QueryRow("SELECT qname, answer FROM dns_records WHERE id = ?", id).Scan(&r.QName, &r.Answer)
+	return r, err
+}
+
+// CreateRecord inserts a dns_records row and returns it with its id.
+func (s *Store) CreateRecord(r Record) (Record, error) {
+	result, err := s.db.Exec("INSERT INTO dns_records (qname, answer) VALUES (?, ?)", r.QName, r.Answer)
+	if err != nil {
+		return Record{}, err
+	}
+	r.ID, err = result.LastInsertId()
+	s.InvalidateAnswers()
+	return r, err
+}
+
+// UpdateRecord replaces the qname and answer of an existing dns_records row.
+func (s *Store) UpdateRecord(r Record) error {
+	result, err := s.db.Exec("UPDATE dns_records SET qname = ?, answer = ? WHERE id = ?", r.QName, r.Answer, r.ID)
+	if err != nil {
+		return err
+	}
+	s.InvalidateAnswers()
+	return expectOneRow(result)
+}
+
+// DeleteRecord removes a dns_records row.
+func (s *Store) DeleteRecord(id int64) error {
+	result, err := s.db.Exec("DELETE FROM dns_records WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	s.InvalidateAnswers()
+	return expectOneRow(result)
+}
+
+// RecentQueries returns the most recent dns_queries rows matching filter,
+// newest first.
+func (s *Store) RecentQueries(filter QueryFilter) ([]QueryRow, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.QName != "" {
+		conditions = append(conditions, "qname = ? COLLATE NOCASE")
+		args = append(args, filter.QName)
+	}
+	if filter.Suffix != "" {
+		conditions = append(conditions, "qname LIKE ?")
+		args = append(args, "%"+filter.Suffix)
+	}
+	if filter.SourceIP != "" {
+		conditions = append(conditions, "source_ip = ?")
+		args = append(args, filter.SourceIP)
+	}
+	if filter.QType != "" {
+		conditions = append(conditions, "qtype = ?")
+		args = append(args, strings.ToUpper(filter.QType))
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "action = ?")
+		args = append(args, filter.Action)
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "timestamp <= ?")
+		args = append(args, filter.Until)
+	}
+
+	query := `SELECT id, timestamp, source_ip, IFNULL(source_port, 0), IFNULL(transport, ''), qname,
+		IFNULL(qtype, ''), IFNULL(rcode, ''), IFNULL(answer, ''), IFNULL(client_subnet, ''), IFNULL(action, '') FROM dns_queries`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", filter.Limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queries := []QueryRow{}
+	for rows.Next() {
+		var q QueryRow
+		err := rows.Scan(&q.ID, &q.Timestamp, &q.SourceIP, &q.SourcePort, &q.Transport, &q.QName,
+			&q.QType, &q.Rcode, &q.Answer, &q.ClientSubnet, &q.Action)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, q)
+	}
+	return queries, rows.Err()
+}
+
+// expectOneRow returns sql.ErrNoRows when a statement affected no rows.
+func expectOneRow(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
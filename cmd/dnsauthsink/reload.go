@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// AnswerSet is an immutable snapshot of the loaded zones and rules.
+type AnswerSet struct {
+	Zones *ZoneStore
+	Rules []*Rule
+}
+
+// AnswerStore holds the current AnswerSet and reloads it from disk when the
+// process receives SIGHUP or one of the source files changes.
+type AnswerStore struct {
+	zoneFiles []string
+	rulesFile string
+	current   atomic.Pointer[AnswerSet]
+	modTimes  map[string]time.Time
+}
+
+// newAnswerStore loads the zone and rules files and returns a store holding them.
+func newAnswerStore(zoneFiles []string, rulesFile string) (*AnswerStore, error) {
+	store := &AnswerStore{
+		zoneFiles: zoneFiles,
+		rulesFile: rulesFile,
+	}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Current returns the answer set currently in use.
+func (s *AnswerStore) Current() *AnswerSet {
+	return s.current.Load()
+}
+
+// Reload re-reads every source file. On error the previous answer set is kept,
+// and the files are not reloaded again until they change.
+func (s *AnswerStore) Reload() error {
+	s.modTimes = s.statFiles()
+
+	zones, err := loadZoneFiles(s.zoneFiles)
+	if err != nil {
+		return err
+	}
+
+	var rules []*Rule
+	if s.rulesFile != "" {
+		rules, err = loadRules(s.rulesFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.current.Store(&AnswerSet{Zones: zones, Rules: rules})
+	return nil
+}
+
+// Watch reloads the store on SIGHUP and, when interval is positive, whenever a
+// source file's modification time changes. It never returns.
+func (s *AnswerStore) Watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-hup:
+			log.Println("SIGHUP received, reloading zones and rules")
+		case <-tick:
+			if !s.changed() {
+				continue
+			}
+			log.Println("Zone or rules file changed, reloading")
+		}
+
+		if err := s.Reload(); err != nil {
+			log.Printf("Reload failed, keeping previous answers: %v", err)
+		}
+	}
+}
+
+// files returns every file the store is loaded from.
+func (s *AnswerStore) files() []string {
+	files := append([]string{}, s.zoneFiles...)
+	if s.rulesFile != "" {
+		files = append(files, s.rulesFile)
+	}
+	return files
+}
+
+// statFiles returns the modification time of every source file.
+func (s *AnswerStore) statFiles() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, path := range s.files() {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// changed reports whether any source file changed since the last load.
+func (s *AnswerStore) changed() bool {
+	for path, modTime := range s.statFiles() {
+		if !modTime.Equal(s.modTimes[path]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/miekg/dns"
+)
+
+// Rule describes how to answer queries whose name matches a wildcard or
+// regular expression pattern. Rules are evaluated in file order and the first
+// matching rule wins, so source-specific (split horizon) rules should be
+// listed before their catch-all counterparts.
+//
+// Example rules file:
+//
+//	[
+//	  {"name": "internal", "match": "*.example.com.", "sources": ["10.0.0.0/8"], "answers": ["10.0.0.53"]},
+//	  {"name": "echo", "regex": "^([0-9-]+)\\.echo\\.example\\.com\\.$", "answers": ["{{ip (index .Groups 1)}}"]},
+//	  {"name": "catch-all", "match": "*.example.com.", "type": "A", "ttl": 60, "answers": ["192.0.2.1"]}
+//	]
+type Rule struct {
+	Name    string   `json:"name"`
+	Match   string   `json:"match"`   // wildcard pattern, "*" matches one or more labels
+	Regex   string   `json:"regex"`   // regular expression matched against the lowercase qname
+	QTypes  []string `json:"qtypes"`  // query types the rule answers, Type (NODATA for others) when empty
+	Sources []string `json:"sources"` // source CIDRs the rule applies to, all when empty
+	Type    string   `json:"type"`    // record type of the answers, defaults to A
+	TTL     uint32   `json:"ttl"`
+	Rcode   string   `json:"rcode"`   // response code, e.g. NXDOMAIN or REFUSED
+	Answers []string `json:"answers"` // rdata templates for the answer records
+
+	pattern   *regexp.Regexp
+	qtypes    map[uint16]bool
+	sources   []*net.IPNet
+	rrtype    uint16
+	rcode     int
+	templates []*template.Template
+}
+
+// RuleMatch is the data made available to answer templates.
+type RuleMatch struct {
+	QName    string   // query name as received
+	QType    string   // query type mnemonic
+	SourceIP string   // address of the client
+	Labels   []string // labels of the query name, leftmost first
+	Prefix   string   // part of the query name matched by a leading "*."
+	Groups   []string // regular expression submatches, Groups[0] is the whole name
+}
+
+// templateFuncs are the helper functions available to answer templates.
+var templateFuncs = template.FuncMap{
+	"ip":    labelToIP,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"split": strings.Split,
+	"join":  strings.Join,
+}
+
+// loadRules reads and compiles a JSON rules file.
+func loadRules(path string) ([]*Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing rules file %s: %w", path, err)
+	}
+
+	for i, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("rules file %s: rule %d (%s): %w", path, i, rule.Name, err)
+		}
+	}
+	return rules, nil
+}
+
+// compile validates the rule and prepares its patterns and templates.
+func (r *Rule) compile() error {
+	switch {
+	case r.Match != "" && r.Regex != "":
+		return fmt.Errorf("only one of match and regex may be set")
+	case r.Match != "":
+		r.pattern = wildcardToRegexp(r.Match)
+	case r.Regex != "":
+		pattern, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return err
+		}
+		r.pattern = pattern
+	default:
+		return fmt.Errorf("one of match or regex is required")
+	}
+
+	r.qtypes = make(map[uint16]bool)
+	for _, name := range r.QTypes {
+		qtype, ok := dns.StringToType[strings.ToUpper(name)]
+		if !ok {
+			return fmt.Errorf("unknown query type %q", name)
+		}
+		r.qtypes[qtype] = true
+	}
+
+	for _, cidr := range r.Sources {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		r.sources = append(r.sources, ipnet)
+	}
+
+	r.rrtype = dns.TypeA
+	if r.Type != "" {
+		rrtype, ok := dns.StringToType[strings.ToUpper(r.Type)]
+		if !ok {
+			return fmt.Errorf("unknown record type %q", r.Type)
+		}
+		r.rrtype = rrtype
+	}
+
+	r.rcode = dns.RcodeSuccess
+	if r.Rcode != "" {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(r.Rcode)]
+		if !ok {
+			return fmt.Errorf("unknown rcode %q", r.Rcode)
+		}
+		r.rcode = rcode
+	}
+
+	for _, answer := range r.Answers {
+		tmpl, err := template.New(r.Name).Funcs(templateFuncs).Parse(answer)
+		if err != nil {
+			return err
+		}
+		r.templates = append(r.templates, tmpl)
+	}
+	return nil
+}
+
+// match reports whether the rule applies to the query and returns the template
+// data describing the match.
+func (r *Rule) match(q dns.Question, srcIP net.IP) (RuleMatch, bool) {
+	if len(r.qtypes) > 0 && !r.qtypes[q.Qtype] {
+		return RuleMatch{}, false
+	}
+
+	if len(r.sources) > 0 && !containsIP(r.sources, srcIP) {
+		return RuleMatch{}, false
+	}
+
+	groups := r.pattern.FindStringSubmatch(strings.ToLower(dns.Fqdn(q.Name)))
+	if groups == nil {
+		return RuleMatch{}, false
+	}
+
+	m := RuleMatch{
+		QName:    q.Name,
+		QType:    dns.TypeToString[q.Qtype],
+		SourceIP: srcIP.String(),
+		Labels:   dns.SplitDomainName(q.Name),
+		Groups:   groups,
+	}
+	if strings.HasPrefix(r.Match, "*.") && len(groups) > 1 {
+		m.Prefix = strings.TrimSuffix(groups[1], ".")
+	}
+	return m, true
+}
+
+// answers reports whether the rule's records answer a query of type qtype.
+// A rule without qtypes matches every type of query for its names but only
+// ANY and queries of its own record type, or any type for CNAME rules, get
+// its records; the others are answered with NODATA. Rules that only set an
+// rcode answer every query they match.
+func (r *Rule) answers(qtype uint16) bool {
+	if len(r.templates) == 0 || len(r.qtypes) > 0 {
+		return true
+	}
+	return qtype == r.rrtype || qtype == dns.TypeANY || r.rrtype == dns.TypeCNAME
+}
+
+// answer renders the rule's answer records for a match.
+func (r *Rule) answer(m RuleMatch) ([]dns.RR, error) {
+	var rrs []dns.RR
+	for _, tmpl := range r.templates {
+		var rdata bytes.Buffer
+		if err := tmpl.Execute(&rdata, m); err != nil {
+			return nil, err
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(m.QName), r.TTL, dns.TypeToString[r.rrtype], rdata.String()))
+		if err != nil {
+			return nil, err
+		}
+		if rr == nil {
+			return nil, fmt.Errorf("rule %s rendered an empty answer", r.Name)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// wildcardToRegexp converts a name pattern such as "*.example.com." into an
+// anchored, case-insensitive regular expression. Each "*" matches one or more
+// labels and is captured as a submatch.
+func wildcardToRegexp(pattern string) *regexp.Regexp {
+	parts := strings.Split(strings.ToLower(dns.Fqdn(pattern)), "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, `([^.]+(?:\.[^.]+)*)`) + "$")
+}
+
+// labelToIP decodes an IPv4 address embedded in a label, accepting dotted
+// ("1.2.3.4"), dashed ("1-2-3-4") and hexadecimal ("01020304") forms. It
+// returns an empty string when the label does not hold an address.
+func labelToIP(label string) string {
+	label = strings.ToLower(strings.Trim(label, "."))
+
+	if ip := net.ParseIP(strings.ReplaceAll(label, "-", ".")); ip != nil {
+		return ip.String()
+	}
+
+	if len(label) == 8 {
+		if b, err := hex.DecodeString(label); err == nil {
+			return net.IP(b).String()
+		}
+	}
+	return ""
+}
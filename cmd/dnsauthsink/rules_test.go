@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/clwg/netsecutils/pkg/dnsrecord"
+	"github.com/miekg/dns"
+)
+
+func TestRuleQTypes(t *testing.T) {
+	rules := []*Rule{
+		{Name: "mail", Regex: `^mx\.`, Type: "MX", Answers: []string{"10 mail.example.com."}},
+		{Name: "alias", Match: "www.example.com.", Type: "CNAME", Answers: []string{"example.com."}},
+		{Name: "txt", Match: "*.txt.example.com.", QTypes: []string{"TXT"}, Type: "TXT", Answers: []string{`"hello"`}},
+		{Name: "blocked", Regex: `^bad\.`, Rcode: "NXDOMAIN"},
+		{Name: "catch-all", Match: "*.example.com.", Answers: []string{"192.0.2.1"}},
+	}
+	for _, rule := range rules {
+		if err := rule.compile(); err != nil {
+			t.Fatalf("rule %s: %v", rule.Name, err)
+		}
+	}
+	sink := &Sink{}
+	answers := &AnswerSet{Rules: rules}
+
+	for _, tt := range []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer string // type and rdata, empty for an empty answer section
+	}{
+		{"mx.example.com.", dns.TypeMX, dns.RcodeSuccess, "MX 10 mail.example.com."},
+		{"mx.example.com.", dns.TypeANY, dns.RcodeSuccess, "MX 10 mail.example.com."},
+		{"mx.example.com.", dns.TypeA, dns.RcodeSuccess, ""},
+		{"mx.example.com.", dns.TypeAAAA, dns.RcodeSuccess, ""},
+		{"www.example.com.", dns.TypeAAAA, dns.RcodeSuccess, "CNAME example.com."},
+		{"a.txt.example.com.", dns.TypeTXT, dns.RcodeSuccess, `TXT "hello"`},
+		{"a.txt.example.com.", dns.TypeA, dns.RcodeSuccess, "A 192.0.2.1"},
+		{"bad.example.com.", dns.TypeAAAA, dns.RcodeNameError, ""},
+		{"host.example.com.", dns.TypeA, dns.RcodeSuccess, "A 192.0.2.1"},
+		{"host.example.com.", dns.TypeTXT, dns.RcodeSuccess, ""},
+	} {
+		m := new(dns.Msg)
+		q := dns.Question{Name: tt.name, Qtype: tt.qtype, Qclass: dns.ClassINET}
+		sink.resolve(m, answers, q, "192.0.2.53")
+
+		qtype := dns.TypeToString[tt.qtype]
+		if !m.Authoritative || m.Rcode != tt.rcode {
+			t.Errorf("%s %s: aa = %v, rcode = %s, want authoritative %s", tt.name, qtype, m.Authoritative, dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.rcode])
+		}
+		var answer string
+		if len(m.Answer) > 0 {
+			answer = dns.TypeToString[m.Answer[0].Header().Rrtype] + " " + dnsrecord.RdataString(m.Answer)
+		}
+		if answer != tt.answer {
+			t.Errorf("%s %s: answer = %q, want %q", tt.name, qtype, answer, tt.answer)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// statsWindow is the period over which top qnames and sources are counted.
+	statsWindow = time.Minute
+	// maxStatsKeys bounds the number of distinct names and sources tracked per
+	// window so that scans of random names cannot exhaust memory.
+	maxStatsKeys = 100000
+)
+
+// Stats tracks live query counters for the management API.
+type Stats struct {
+	mu          sync.Mutex
+	started     time.Time
+	total       int64
+	perSecond   [61]int64 // ring buffer of query counts per second, plus the current one
+	lastSecond  int64
+	windowStart time.Time
+	qnames      map[string]int64
+	sources     map[string]int64
+	prevQnames  map[string]int64
+	prevSources map[string]int64
+}
+
+// StatsSnapshot is the JSON representation of the live stats.
+type StatsSnapshot struct {
+	Uptime     string       `json:"uptime"`
+	Total      int64        `json:"total_queries"`
+	QPS        float64      `json:"qps"`     // average over the last 10 seconds
+	QPS60      float64      `json:"qps_60s"` // average over the last minute
+	TopQnames  []CountEntry `json:"top_qnames"`
+	TopSources []CountEntry `json:"top_sources"`
+}
+
+// CountEntry is a key with its count.
+type CountEntry struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// newStats returns an empty Stats.
+func newStats() *Stats {
+	now := time.Now()
+	return &Stats{
+		started:     now,
+		lastSecond:  now.Unix(),
+		windowStart: now,
+		qnames:      make(map[string]int64),
+		sources:     make(map[string]int64),
+	}
+}
+
+// Record counts a query.
+func (s *Stats) Record(qname, srcIP string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.advance(now)
+	s.total++
+	s.perSecond[now.Unix()%61]++
+	increment(s.qnames, qname)
+	increment(s.sources, srcIP)
+}
+
+// Snapshot returns the current stats with the n most frequent qnames and
+// sources over the last one to two minutes.
+func (s *Stats) Snapshot(n int) StatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.advance(now)
+
+	var last10, last60 int64
+	current := now.Unix()
+	for i := int64(1); i <= 60; i++ {
+		count := s.perSecond[(current-i)%61]
+		if i <= 10 {
+			last10 += count
+		}
+		last60 += count
+	}
+
+	return StatsSnapshot{
+		Uptime:     now.Sub(s.started).Round(time.Second).String(),
+		Total:      s.total,
+		QPS:        float64(last10) / 10,
+		QPS60:      float64(last60) / 60,
+		TopQnames:  topCounts(n, s.qnames, s.prevQnames),
+		TopSources: topCounts(n, s.sources, s.prevSources),
+	}
+}
+
+// advance clears per-second buckets and rotates the counting window up to now.
+func (s *Stats) advance(now time.Time) {
+	current := now.Unix()
+	for second := s.lastSecond + 1; second <= current && second <= s.lastSecond+61; second++ {
+		s.perSecond[second%61] = 0
+	}
+	if current > s.lastSecond {
+		s.lastSecond = current
+	}
+
+	if elapsed := now.Sub(s.windowStart); elapsed >= statsWindow {
+		s.prevQnames, s.prevSources = s.qnames, s.sources
+		if elapsed >= 2*statsWindow {
+			s.prevQnames, s.prevSources = nil, nil
+		}
+		s.qnames = make(map[string]int64)
+		s.sources = make(map[string]int64)
+		s.windowStart = now
+	}
+}
+
+// increment adds one to key unless the map is full.
+func increment(counts map[string]int64, key string) {
+	if _, ok := counts[key]; ok || len(counts) < maxStatsKeys {
+		counts[key]++
+	}
+}
+
+// topCounts returns the n largest combined counts of the given maps.
+func topCounts(n int, maps ...map[string]int64) []CountEntry {
+	combined := make(map[string]int64)
+	for _, counts := range maps {
+		for key, count := range counts {
+			combined[key] += count
+		}
+	}
+
+	entries := make([]CountEntry, 0, len(combined))
+	for key, count := range combined {
+		entries = append(entries, CountEntry{Key: key, Count: count})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
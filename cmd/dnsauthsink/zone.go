@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ZoneStore holds the records loaded from one or more RFC 1035 zone files.
+type ZoneStore struct {
+	origins []string            // zone apexes, longest first
+	soa     map[string]*dns.SOA // SOA record per apex
+	records map[string][]dns.RR // records keyed by lowercase owner name
+	names   map[string]bool     // every owner name and empty non-terminal
+}
+
+// ZoneResult is the outcome of looking up a name in the zone store.
+type ZoneResult struct {
+	Answer []dns.RR
+	Ns     []dns.RR
+	Rcode  int
+}
+
+// newZoneStore returns an empty zone store.
+func newZoneStore() *ZoneStore {
+	return &ZoneStore{
+		soa:     make(map[string]*dns.SOA),
+		records: make(map[string][]dns.RR),
+		names:   make(map[string]bool),
+	}
+}
+
+// loadZoneFiles parses the given zone files into a single zone store.
+func loadZoneFiles(paths []string) (*ZoneStore, error) {
+	store := newZoneStore()
+	for _, path := range paths {
+		if err := store.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// loadFile parses a zone file and adds its records to the store. The zone
+// file must either contain an $ORIGIN directive or use fully qualified names.
+func (z *ZoneStore) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var rrs []dns.RR
+	var apex string
+	zp := dns.NewZoneParser(file, "", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			apex = strings.ToLower(soa.Hdr.Name)
+			z.soa[apex] = soa
+		}
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return fmt.Errorf("parsing zone file %s: %w", path, err)
+	}
+	if apex == "" {
+		return fmt.Errorf("zone file %s has no SOA record", path)
+	}
+
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(apex, name) {
+			return fmt.Errorf("zone file %s: %s is outside of zone %s", path, rr.Header().Name, apex)
+		}
+		z.records[name] = append(z.records[name], rr)
+
+		// Register the owner and every ancestor up to the apex so that empty
+		// non-terminals are answered with NODATA rather than NXDOMAIN.
+		for n := name; ; {
+			z.names[n] = true
+			if n == apex {
+				break
+			}
+			n = parentName(n)
+		}
+	}
+
+	z.origins = append(z.origins, apex)
+	sort.Slice(z.origins, func(i, j int) bool {
+		return dns.CountLabel(z.origins[i]) > dns.CountLabel(z.origins[j])
+	})
+	return nil
+}
+
+// zoneFor returns the apex of the most specific loaded zone containing qname.
+func (z *ZoneStore) zoneFor(qname string) (string, bool) {
+	for _, origin := range z.origins {
+		if dns.IsSubDomain(origin, qname) {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+// Lookup answers qname/qtype from the loaded zones. The boolean result is false
+// when qname does not fall within any loaded zone.
+func (z *ZoneStore) Lookup(qname string, qtype uint16) (ZoneResult, bool) {
+	qname = strings.ToLower(dns.Fqdn(qname))
+	apex, ok := z.zoneFor(qname)
+	if !ok {
+		return ZoneResult{}, false
+	}
+
+	var result ZoneResult
+	owner := qname
+	for depth := 0; depth < 8; depth++ {
+		rrs, found := z.find(apex, owner)
+		if !found {
+			if len(result.Answer) == 0 {
+				result.Rcode = dns.RcodeNameError
+			}
+			break
+		}
+
+		var cname *dns.CNAME
+		matched := false
+		for _, rr := range rrs {
+			rrtype := rr.Header().Rrtype
+			if rrtype == qtype || qtype == dns.TypeANY {
+				result.Answer = append(result.Answer, rr)
+				matched = true
+			} else if c, isCNAME := rr.(*dns.CNAME); isCNAME {
+				cname = c
+			}
+		}
+		if matched || cname == nil {
+			break
+		}
+
+		// Follow the CNAME chain while it stays within our zones.
+		result.Answer = append(result.Answer, cname)
+		target := strings.ToLower(cname.Target)
+		next, inZone := z.zoneFor(target)
+		if !inZone {
+			break
+		}
+		apex, owner = next, target
+	}
+
+	if len(result.Answer) == 0 {
+		result.Ns = []dns.RR{z.soa[apex]}
+	}
+	return result, true
+}
+
+// find returns the records owned by name within the zone at apex, synthesising
+// them from a wildcard when the name does not exist. The boolean result is
+// false when the name does not exist and no wildcard covers it.
+func (z *ZoneStore) find(apex, name string) ([]dns.RR, bool) {
+	if z.names[name] {
+		return z.records[name], true
+	}
+
+	// Find the closest encloser and look for a wildcard directly below it.
+	for encloser := parentName(name); dns.IsSubDomain(apex, encloser); encloser = parentName(encloser) {
+		if !z.names[encloser] {
+			continue
+		}
+		wildcard := z.records["*."+encloser]
+		if len(wildcard) == 0 {
+			return nil, false
+		}
+		synthesized := make([]dns.RR, 0, len(wildcard))
+		for _, rr := range wildcard {
+			copied := dns.Copy(rr)
+			copied.Header().Name = name
+			synthesized = append(synthesized, copied)
+		}
+		return synthesized, true
+	}
+	return nil, false
+}
+
+// parentName returns name with its leftmost label removed.
+func parentName(name string) string {
+	if name == "." {
+		return "."
+	}
+	off, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[off:]
+}
@@ -1,82 +1,257 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"flag"
-	"fmt"
+	"log"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/clwg/netsecutils/pkg/dnsrecord"
+	jsonllogger "github.com/clwg/netsecutils/pkg/logging"
+	"github.com/clwg/netsecutils/pkg/probename"
+	"github.com/clwg/netsecutils/pkg/ratelimit"
+	"github.com/clwg/netsecutils/pkg/target"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/miekg/dns"
 )
 
-type DnsQuery struct {
-	Timestamp time.Time `json:"timestamp"`
-	Ip        string    `json:"ip"`
-	Domain    string    `json:"domain"`
-	Query     string    `json:"query"`
-	Answer    string    `json:"answer"`
+// maxPrefixBits bounds the size of IPv6 prefixes and ranges to
+// 2^maxPrefixBits addresses; larger IPv6 networks are scanned from hit lists
+// instead.
+const maxPrefixBits = 16
+
+// Probe is the outcome of one probe query.
+type Probe struct {
+	Timestamp time.Time // time the last attempt was sent
+	ScanID    string
+	Target    string
+	QName     string // name of the last attempt
+	QType     string
+	Attempts  int
+	Rcode     string `json:",omitempty"`
+	Answers   string `json:",omitempty"` // comma-separated record data
+	RTTMs     float64
+	Error     string `json:",omitempty"` // error of the last attempt when unanswered
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS probes (
+    timestamp TIMESTAMP,
+    scan_id TEXT,
+    target TEXT,
+    qname TEXT,
+    qtype TEXT,
+    attempts INTEGER,
+    rcode TEXT,
+    answers TEXT,
+    rtt_ms REAL,
+    error TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_probes_scan_id ON probes (scan_id);
+`
+
+// Mapper sends probe queries to targets.
+type Mapper struct {
+	Codec   *probename.Codec
+	Client  *dns.Client
+	Limiter *ratelimit.Limiter
+	QTypes  []uint16
+	Retries int // additional attempts after a timeout
+	ScanID  string
 }
 
 func main() {
-	domain := flag.String("domain", "", "Domain to query")
-	network := flag.String("network", "", "Network range to query")
+	domain := flag.String("domain", "", "Probe zone the names are generated under")
+	network := flag.String("network", "", "Comma-separated list of networks, ranges, addresses, hostnames or @files to query")
+	targetFile := flag.String("targets", "", "File of targets to query, one per line")
+	exclude := flag.String("exclude", "", "Comma-separated list of networks, ranges, addresses, hostnames or @files to skip")
+	random := flag.Bool("random", false, "Probe targets in a random order")
+	seed := flag.Int64("seed", 0, "Seed of the random target order (default: time based)")
+	qtypes := flag.String("qtypes", "A,AAAA", "Comma-separated list of query types sent to each target")
 	timeout := flag.Int("timeout", 5, "Timeout for DNS queries in seconds")
+	retries := flag.Int("retries", 2, "Number of retries after a timeout")
+	concurrency := flag.Int("concurrency", 100, "Number of targets probed in parallel")
+	pps := flag.Int("pps", 200, "Maximum queries per second (0 for unlimited)")
+	encoding := flag.String("encoding", "plain", "Encoding of the target address in probe names: plain, dictionary or keyed")
+	dictionary := flag.String("dictionary", "dictionary.txt", "ipcipher dictionary file for dictionary encoding")
+	key := flag.String("key", "", "ipcipher passphrase for keyed encoding")
+	scanID := flag.String("scan-id", "", "Identifier of this run embedded in every name (default: random)")
+	dbfile := flag.String("db", "probes.db", "SQLite database file")
 	flag.Parse()
 
-	client := dns.Client{Timeout: time.Duration(*timeout) * time.Second}
+	if *domain == "" {
+		log.Fatal("-domain is required")
+	}
+
+	var types []uint16
+	for _, name := range strings.Split(*qtypes, ",") {
+		qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			log.Fatalf("Unknown query type %q", name)
+		}
+		types = append(types, qtype)
+	}
+
+	specs := []string{*network}
+	if *targetFile != "" {
+		specs = append(specs, "@"+*targetFile)
+	}
+	parser := &target.Parser{MaxIPv6Bits: maxPrefixBits}
+	targets, err := parser.Parse(specs, []string{*exclude})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	enc, err := probename.ParseEncoding(*encoding)
+	if err != nil {
+		log.Fatal(err)
+	}
+	codec, err := probename.NewCodec(*domain, enc, *dictionary, *key)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *scanID == "" {
+		*scanID = strconv.FormatInt(time.Now().UnixNano()%(36*36*36*36*36*36*36*36), 36)
+	}
+	if !probename.IsScanID(*scanID) {
+		log.Fatalf("Invalid -scan-id %q: must be 1 to 16 lower case letters and digits", *scanID)
+	}
+
+	config := jsonllogger.LoggerConfig{
+		FilenamePrefix: "dnsforwardingmapper",
+		LogDir:         "./logs",
+		MaxLines:       50000,
+		RotationTime:   30 * time.Minute,
+	}
 
-	ip, ipnet, err := net.ParseCIDR(*network)
+	jsonLogger, err := jsonllogger.NewLogger(config)
 	if err != nil {
 		panic(err)
 	}
 
-	for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
-		combinedDomain := fmt.Sprintf("%s.%s", ip.String(), *domain) // Combining IP and domain
-		msg := dns.Msg{}
-		msg.SetQuestion(dns.Fqdn(combinedDomain), dns.TypeA)
-		resp, _, err := client.Exchange(&msg, net.JoinHostPort(ip.String(), "53"))
-		if err != nil {
-			fmt.Printf("query request timeout: %s\n", err)
-			continue
-		}
+	db, err := sqlx.Open("sqlite3", *dbfile)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
 
-		query := dnsQuestionToString(msg.Question[0])
-		answer := dnsRRToString(resp.Answer)
+	if _, err := db.Exec(schema); err != nil {
+		panic(err)
+	}
+
+	mapper := &Mapper{
+		Codec:   codec,
+		Client:  &dns.Client{Timeout: time.Duration(*timeout) * time.Second},
+		Limiter: ratelimit.New(*pps),
+		QTypes:  types,
+		Retries: *retries,
+		ScanID:  *scanID,
+	}
+	log.Printf("Scan %s: probing %d targets", mapper.ScanID, targets.Len())
 
-		dnsQuery := DnsQuery{
-			Timestamp: time.Now(),
-			Ip:        ip.String(),
-			Domain:    combinedDomain,
-			Query:     query,
-			Answer:    answer,
+	jobs := make(chan net.IP)
+	go func() {
+		defer close(jobs)
+		order := target.NewPermutation(targets.Len(), *seed, *random)
+		for i := uint64(0); i < targets.Len(); i++ {
+			jobs <- targets.At(order.At(i))
 		}
+	}()
+
+	results := make(chan Probe)
+	var wg sync.WaitGroup
+
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ip := range jobs {
+				for _, probe := range mapper.Probe(ip) {
+					results <- probe
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var sent, answered int
+	for probe := range results {
+		jsonLogger.Log(probe)
 
-		jsonData, err := json.Marshal(dnsQuery)
-		if err != nil {
-			panic(err)
+		insertProbe(db, probe)
+
+		sent++
+		if probe.Error == "" {
+			answered++
 		}
-		fmt.Println(string(jsonData))
 	}
+	log.Printf("Scan %s: %d probes sent, %d answered", mapper.ScanID, sent, answered)
 }
 
-func inc(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		ip[j]++
-		if ip[j] > 0 {
+// Probe sends each query type to ip. Every attempt queries a new name
+// encoding ip, its send time and the scan ID, so the delay measured at the
+// sink covers that attempt alone and retries are not answered from caches.
+func (m *Mapper) Probe(ip net.IP) []Probe {
+	var probes []Probe
+	for _, qtype := range m.QTypes {
+		probe := Probe{
+			ScanID: m.ScanID,
+			Target: ip.String(),
+			QType:  dns.TypeToString[qtype],
+		}
+
+		for probe.Attempts <= m.Retries {
+			m.Limiter.Wait()
+			probe.Timestamp = time.Now()
+			name, err := m.Codec.Encode(probename.Probe{Target: ip, Timestamp: probe.Timestamp, Scan: m.ScanID})
+			if err != nil {
+				log.Printf("%s: %v", ip, err)
+				return probes
+			}
+			probe.QName = name
+			probe.Attempts++
+
+			msg := new(dns.Msg)
+			msg.SetQuestion(name, qtype)
+			resp, rtt, err := m.Client.Exchange(msg, net.JoinHostPort(ip.String(), "53"))
+			if err != nil {
+				probe.Error = err.Error()
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					continue
+				}
+				break
+			}
+			probe.Error = ""
+			probe.Rcode = dns.RcodeToString[resp.Rcode]
+			probe.Answers = dnsrecord.RdataString(resp.Answer)
+			probe.RTTMs = float64(rtt.Microseconds()) / 1000
 			break
 		}
+		probes = append(probes, probe)
 	}
+	return probes
 }
 
-func dnsQuestionToString(q dns.Question) string {
-	return fmt.Sprintf("%s %s", q.Name, dns.TypeToString[q.Qtype])
-}
-
-func dnsRRToString(rr []dns.RR) string {
-	var str string
-	for _, r := range rr {
-		str += r.String() + "\n"
+func insertProbe(db *sqlx.DB, probe Probe) {
+	_, err := db.Exec(`INSERT INTO probes (timestamp, scan_id, target, qname, qtype, attempts, rcode, answers, rtt_ms, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		probe.Timestamp, probe.ScanID, probe.Target, probe.QName, probe.QType, probe.Attempts,
+		probe.Rcode, probe.Answers, probe.RTTMs, probe.Error)
+	if err != nil {
+		panic(err)
 	}
-	return str
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/clwg/netsecutils/pkg/target"
+	"github.com/miekg/dns"
+)
+
+// measureAmplification sends each amplification query type for each name
+// with a large EDNS0 buffer and returns the resulting dns_queries rows. The
+// largest ratio seen is recorded on the resolver.
+func (s *Scanner) measureAmplification(ip net.IP, resolver *Resolver) []DnsQuery {
+	var queries []DnsQuery
+	for _, name := range s.AmpNames {
+		for _, qtype := range s.AmpTypes {
+			msg := new(dns.Msg)
+			msg.SetQuestion(dns.Fqdn(name), qtype)
+			msg.SetEdns0(s.EDNSSize, true)
+
+			r, err := s.exchange(ip, msg)
+			if err != nil {
+				continue
+			}
+
+			query := s.newQuery(ip, name, msg, r)
+			if query.Amplification > resolver.MaxAmplification {
+				resolver.MaxAmplification = query.Amplification
+			}
+			queries = append(queries, query)
+		}
+	}
+	return queries
+}
+
+// parseQueryTypes parses a comma-separated list of query type mnemonics.
+func parseQueryTypes(list string) ([]uint16, error) {
+	var qtypes []uint16
+	for _, name := range target.SplitList(list) {
+		qtype, ok := dns.StringToType[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown query type %q", name)
+		}
+		qtypes = append(qtypes, qtype)
+	}
+	return qtypes, nil
+}
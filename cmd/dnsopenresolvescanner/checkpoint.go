@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const scansSchema = `
+CREATE TABLE IF NOT EXISTS scans (
+    id INTEGER PRIMARY KEY,
+    started TIMESTAMP,
+    updated TIMESTAMP,
+    targets TEXT,
+    exclude TEXT,
+    seed INTEGER,
+    random BOOLEAN,
+    total INTEGER,
+    next_index INTEGER,
+    completed BOOLEAN
+);
+`
+
+// Scan is a row of the scans table. Targets and excludes are stored so that
+// an interrupted scan can be resumed with the same target order.
+type Scan struct {
+	ID        int64     `db:"id"`
+	Started   time.Time `db:"started"`
+	Updated   time.Time `db:"updated"`
+	Targets   string    `db:"targets"`
+	Exclude   string    `db:"exclude"`
+	Seed      int64     `db:"seed"`
+	Random    bool      `db:"random"`
+	Total     uint64    `db:"total"`
+	NextIndex uint64    `db:"next_index"`
+	Completed bool      `db:"completed"`
+}
+
+// createScan stores a new scan.
+func createScan(db *sqlx.DB, targets, exclude []string, seed int64, random bool, total uint64) (*Scan, error) {
+	scan := &Scan{
+		Started: time.Now(),
+		Updated: time.Now(),
+		Targets: strings.Join(targets, "\n"),
+		Exclude: strings.Join(exclude, "\n"),
+		Seed:    seed,
+		Random:  random,
+		Total:   total,
+	}
+	result, err := db.NamedExec(`INSERT INTO scans (started, updated, targets, exclude, seed, random, total, next_index, completed)
+		VALUES (:started, :updated, :targets, :exclude, :seed, :random, :total, :next_index, :completed)`, scan)
+	if err != nil {
+		return nil, err
+	}
+	scan.ID, err = result.LastInsertId()
+	return scan, err
+}
+
+// loadScan reads a scan to resume.
+func loadScan(db *sqlx.DB, id int64) (*Scan, error) {
+	scan := &Scan{}
+	if err := db.Get(scan, "SELECT * FROM scans WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+	return scan, nil
+}
+
+// saveCheckpoint records the scan's progress.
+func saveCheckpoint(db *sqlx.DB, scan *Scan) error {
+	scan.Updated = time.Now()
+	_, err := db.NamedExec("UPDATE scans SET updated = :updated, next_index = :next_index, completed = :completed WHERE id = :id", scan)
+	return err
+}
+
+// Progress tracks completed scan positions. Workers finish out of order, so
+// the checkpoint is the lowest position not yet completed; on resume a few
+// positions past it may be scanned again.
+type Progress struct {
+	mu   sync.Mutex
+	next uint64
+	done map[uint64]bool
+}
+
+// newProgress returns a tracker starting at position next.
+func newProgress(next uint64) *Progress {
+	return &Progress{next: next, done: make(map[uint64]bool)}
+}
+
+// Done marks position i as completed.
+func (p *Progress) Done(i uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done[i] = true
+	for p.done[p.next] {
+		delete(p.done, p.next)
+		p.next++
+	}
+}
+
+// Next returns the lowest position not yet completed.
+func (p *Progress) Next() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.next
+}
+
+// checkpoint periodically saves progress until stop is closed.
+func checkpoint(db *sqlx.DB, scan *Scan, progress *Progress, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			scan.NextIndex = progress.Next()
+			if err := saveCheckpoint(db, scan); err != nil {
+				log.Printf("Failed to save checkpoint: %v", err)
+			}
+			log.Printf("Scan %d: %d/%d targets", scan.ID, scan.NextIndex, scan.Total)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -3,45 +3,121 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	jsonllogger "github.com/clwg/netsecutils/pkg/logging"
+	"github.com/clwg/netsecutils/pkg/ratelimit"
+	"github.com/clwg/netsecutils/pkg/sqliteutil"
+	"github.com/clwg/netsecutils/pkg/target"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/miekg/dns"
 )
 
 type DnsQuery struct {
-	Timestamp time.Time
-	Ip        string
-	Domain    string
-	Query     string
-	Answer    string
+	Timestamp   time.Time
+	Ip          string
+	ResponseIP  string
+	Domain      string
+	Query       string
+	Rcode       string
+	RA          bool
+	AA          bool
+	TC          bool
+	AnswerCount int
+	Answers     string // comma-separated record data
+	RTTMs       float64
+	ScanID      int64
+
+	RequestSize   int
+	ResponseSize  int
+	Amplification float64 // response size divided by request size
 }
 
+// maxPrefixBits bounds IPv6 prefixes and ranges to 2^maxPrefixBits
+// addresses (a /104); larger IPv6 networks cannot be scanned exhaustively
+// and are scanned from hit lists of addresses instead.
+const maxPrefixBits = 24
+
 const schema = `
 CREATE TABLE IF NOT EXISTS dns_queries (
     timestamp TIMESTAMP,
     ip TEXT,
     domain TEXT,
     query TEXT,
-    answer TEXT
+    scan_id INTEGER,
+    response_ip TEXT,
+    rcode TEXT,
+    ra BOOLEAN,
+    aa BOOLEAN,
+    tc BOOLEAN,
+    answer_count INTEGER,
+    answers TEXT,
+    rtt_ms REAL,
+    request_size INTEGER,
+    response_size INTEGER,
+    amplification REAL
 );
 `
 
+// queryColumns are the dns_queries columns added since the first version of
+// the schema, which databases created by earlier versions are migrated to.
+var queryColumns = [][2]string{
+	{"scan_id", "INTEGER"},
+	{"response_ip", "TEXT"},
+	{"rcode", "TEXT"},
+	{"ra", "BOOLEAN"},
+	{"aa", "BOOLEAN"},
+	{"tc", "BOOLEAN"},
+	{"answer_count", "INTEGER"},
+	{"answers", "TEXT"},
+	{"rtt_ms", "REAL"},
+	{"request_size", "INTEGER"},
+	{"response_size", "INTEGER"},
+	{"amplification", "REAL"},
+}
+
 func main() {
 	domain := flag.String("domain", "", "Domain to query")
-	network := flag.String("network", "", "Network range to query")
+	network := flag.String("network", "", "Comma-separated list of networks, ranges, addresses, hostnames or @files to query")
+	targetFile := flag.String("targets", "", "File of targets to query, one per line")
+	exclude := flag.String("exclude", "", "Comma-separated list of networks, ranges, addresses, hostnames or @files to skip")
+	excludeFile := flag.String("exclude-file", "", "File of targets to skip, one per line")
 	timeout := flag.Int("timeout", 5, "Timeout for DNS queries in seconds")
 	domains := flag.String("domains", "", "Comma-separated list of additional domains to query")
+	queryTypes := flag.String("qtypes", "A,AAAA", "Comma-separated list of query types sent for each domain, the first is used to classify responders")
 	dbfile := flag.String("db", "dns.db", "SQLite database file")
+	concurrency := flag.Int("concurrency", 100, "Number of targets queried in parallel")
+	pps := flag.Int("pps", 100, "Maximum queries per second (0 for unlimited)")
+	random := flag.Bool("random", true, "Query targets in a random order")
+	seed := flag.Int64("seed", 0, "Seed of the random target order (default: time based)")
+	resume := flag.Int64("resume", 0, "ID of an interrupted scan to resume")
+	expect := flag.String("expect", "", "Comma-separated list of correct answers for -domain")
+	amplification := flag.Bool("amplification", false, "Measure the amplification factor of open resolvers")
+	ampNames := flag.String("amp-names", "", "Comma-separated list of names queried to measure amplification (default: -domain)")
+	ampTypes := flag.String("amp-types", "ANY,DNSKEY,TXT", "Comma-separated list of query types sent to measure amplification")
+	ednsSize := flag.Int("edns-size", 4096, "EDNS0 buffer size advertised in amplification queries")
+	tamper := flag.Bool("tamper", false, "Detect answer injection, NXDOMAIN rewriting and other tampering by open resolvers")
+	groundTruth := flag.String("ground-truth", "", "Trusted resolver (host:port) the answers of scanned resolvers are compared with")
+	controlNames := flag.String("control-names", "", "Comma-separated list of names with stable answers checked for tampering (default: -domain)")
+	nxZone := flag.String("nx-zone", "", "Zone under which random nonexistent names are queried (default: -domain)")
+	nxCount := flag.Int("nx-count", 2, "Number of random nonexistent names queried per resolver")
+	minRTT := flag.Int("min-rtt", 0, "Milliseconds below which an answer is physically implausible for the scanned networks (0 disables)")
+	fingerprint := flag.Bool("fingerprint", true, "Identify responders' software with CHAOS version.bind, id.server and hostname.bind queries")
 
 	flag.Parse()
 
+	if *ednsSize < 512 || *ednsSize > 65535 {
+		log.Fatalf("Invalid -edns-size %d: must be between 512 and 65535", *ednsSize)
+	}
+
 	config := jsonllogger.LoggerConfig{
 		FilenamePrefix: "dnsopenresolvescanner",
 		LogDir:         "./logs",
@@ -59,30 +135,151 @@ func main() {
 		panic(err)
 	}
 	defer db.Close()
+	// Results and checkpoints are written from different goroutines.
+	db.SetMaxOpenConns(1)
 
-	if _, err := os.Stat(*dbfile); os.IsNotExist(err) {
-		_, err = db.Exec(schema)
+	if err := initDB(db); err != nil {
+		panic(err)
+	}
+
+	var scan *Scan
+	if *resume != 0 {
+		scan, err = loadScan(db, *resume)
 		if err != nil {
-			panic(err)
+			log.Fatalf("Failed to load scan %d: %v", *resume, err)
+		}
+		if scan.Completed {
+			log.Fatalf("Scan %d is already complete", scan.ID)
 		}
 	}
 
-	client := dns.Client{Timeout: time.Duration(*timeout) * time.Second}
+	var targetSpecs, excludeSpecs []string
+	if scan != nil {
+		targetSpecs, excludeSpecs = splitLines(scan.Targets), splitLines(scan.Exclude)
+	} else {
+		targetSpecs, err = readSpecs(*network, *targetFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		excludeSpecs, err = readSpecs(*exclude, *excludeFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	ip, ipnet, err := net.ParseCIDR(*network)
+	parser := &target.Parser{MaxIPv6Bits: maxPrefixBits}
+	targets, err := parser.Parse(targetSpecs, excludeSpecs)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
+	}
+	if targets.Len() == 0 {
+		log.Fatal("No targets given, use -network or -targets")
+	}
+	if scan != nil && targets.Len() != scan.Total {
+		log.Fatalf("Scan %d: targets now hold %d addresses instead of %d, cannot resume", scan.ID, targets.Len(), scan.Total)
+	}
+
+	if scan == nil {
+		if *seed == 0 {
+			*seed = time.Now().UnixNano()
+		}
+		scan, err = createScan(db, targetSpecs, excludeSpecs, *seed, *random, targets.Len())
+		if err != nil {
+			panic(err)
+		}
+	}
+	log.Printf("Scan %d: %d targets, starting at %d", scan.ID, scan.Total, scan.NextIndex)
+
+	qtypes, err := parseQueryTypes(*queryTypes)
+	if err != nil || len(qtypes) == 0 {
+		log.Fatalf("Invalid -qtypes: %v", err)
+	}
+	ampQTypes, err := parseQueryTypes(*ampTypes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	names := target.SplitList(*ampNames)
+	if len(names) == 0 {
+		names = []string{*domain}
+	}
+
+	var tamperCheck *TamperCheck
+	if *tamper {
+		if *groundTruth == "" {
+			log.Fatal("-tamper requires -ground-truth")
+		}
+		if _, _, err := net.SplitHostPort(*groundTruth); err != nil {
+			log.Fatalf("Invalid -ground-truth %q, expected host:port such as 9.9.9.9:53 or [2620:fe::fe]:53: %v", *groundTruth, err)
+		}
+		controls := target.SplitList(*controlNames)
+		if len(controls) == 0 {
+			controls = []string{*domain}
+		}
+		if *nxZone == "" {
+			*nxZone = *domain
+		}
+		tamperCheck, err = newTamperCheck(*groundTruth, controls, *nxZone, *nxCount,
+			time.Duration(*minRTT)*time.Millisecond, time.Duration(*timeout)*time.Second)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	scanner := &Scanner{
+		Timeout:     time.Duration(*timeout) * time.Second,
+		Limiter:     ratelimit.New(*pps),
+		Domain:      *domain,
+		Domains:     target.SplitList(*domains),
+		QTypes:      qtypes,
+		Expect:      target.SplitList(*expect),
+		Fingerprint: *fingerprint,
+		ScanID:      scan.ID,
+
+		Amplification: *amplification,
+		AmpNames:      names,
+		AmpTypes:      ampQTypes,
+		EDNSSize:      uint16(*ednsSize),
+
+		Tamper: tamperCheck,
 	}
+	order := target.NewPermutation(targets.Len(), scan.Seed, scan.Random)
+	progress := newProgress(scan.NextIndex)
 
-	results := make(chan DnsQuery)
+	stop := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		log.Println("Interrupted, saving checkpoint")
+		close(stop)
+	}()
+
+	jobs := make(chan uint64)
+	go func() {
+		defer close(jobs)
+		for i := scan.NextIndex; i < scan.Total; i++ {
+			select {
+			case jobs <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	results := make(chan TargetResult)
 	var wg sync.WaitGroup
 
-	for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
+	for w := 0; w < *concurrency; w++ {
 		wg.Add(1)
-		go func(ip net.IP) {
+		go func() {
 			defer wg.Done()
-			performDnsQuery(ip, &client, *domain, *domains, db, results)
-		}(net.ParseIP(ip.String()))
+			for i := range jobs {
+				if result := scanner.Scan(targets.At(order.At(i))); result.Resolver != nil {
+					results <- result
+				}
+				progress.Done(i)
+			}
+		}()
 	}
 
 	go func() {
@@ -90,74 +287,117 @@ func main() {
 		close(results)
 	}()
 
+	checkpointStop := make(chan struct{})
+	checkpointDone := make(chan struct{})
+	go func() {
+		checkpoint(db, scan, progress, 5*time.Second, checkpointStop)
+		close(checkpointDone)
+	}()
+
 	for result := range results {
-		jsonLogger.Log(result)
+		for _, query := range result.Queries {
+			jsonLogger.Log(query)
 
-		insertDNSQuery(db, result)
-	}
-}
+			insertDNSQuery(db, query)
+		}
 
-func performDnsQuery(ip net.IP, client *dns.Client, domain string, domains string, db *sqlx.DB, results chan<- DnsQuery) {
-	msg := dns.Msg{}
-	msg.SetQuestion(dns.Fqdn(domain), dns.TypeA)
-	resp, _, err := client.Exchange(&msg, net.JoinHostPort(ip.String(), "53"))
-	if err != nil {
-		fmt.Printf("query request timeout: %s\n", err)
-		return
-	}
+		for _, verdict := range result.Verdicts {
+			jsonLogger.Log(verdict)
 
-	query := dnsQuestionToString(msg.Question[0])
-	answer := dnsRRToString(resp.Answer)
-	results <- DnsQuery{Timestamp: time.Now(), Ip: ip.String(), Domain: domain, Query: query, Answer: answer}
+			insertVerdict(db, verdict)
+		}
 
-	if resp.Rcode == dns.RcodeSuccess && domains != "" {
-		for _, additionalDomain := range strings.Split(domains, ",") {
-			additionalMsg := dns.Msg{}
-			additionalMsg.SetQuestion(dns.Fqdn(additionalDomain), dns.TypeA)
+		jsonLogger.Log(result.Resolver)
+		insertResolver(db, result.Resolver)
+	}
 
-			additionalResp, _, err := client.Exchange(&additionalMsg, net.JoinHostPort(ip.String(), "53"))
-			if err != nil {
-				fmt.Printf("DNS error: %s\n", err)
-				continue
-			}
+	close(checkpointStop)
+	<-checkpointDone
 
-			additionalQuery := dnsQuestionToString(additionalMsg.Question[0])
-			additionalAnswer := dnsRRToString(additionalResp.Answer)
-			results <- DnsQuery{Timestamp: time.Now(), Ip: ip.String(), Domain: additionalDomain, Query: additionalQuery, Answer: additionalAnswer}
-		}
+	scan.NextIndex = progress.Next()
+	scan.Completed = scan.NextIndex == scan.Total
+	if err := saveCheckpoint(db, scan); err != nil {
+		log.Printf("Failed to save checkpoint: %v", err)
 	}
+	if !scan.Completed {
+		log.Printf("Scan %d stopped at %d/%d, continue with -resume %d", scan.ID, scan.NextIndex, scan.Total, scan.ID)
+		os.Exit(1)
+	}
+	log.Printf("Scan %d complete", scan.ID)
 }
 
 func insertDNSQuery(db *sqlx.DB, query DnsQuery) {
-	stmt, err := db.Preparex("INSERT INTO dns_queries (timestamp, ip, domain, query, answer) VALUES (?, ?, ?, ?, ?)")
+	stmt, err := db.Preparex(`INSERT INTO dns_queries (timestamp, ip, domain, query, scan_id, response_ip, rcode, ra, aa, tc, answer_count, answers, rtt_ms,
+		request_size, response_size, amplification)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		panic(err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(query.Timestamp, query.Ip, query.Domain, query.Query, query.Answer)
+	_, err = stmt.Exec(query.Timestamp, query.Ip, query.Domain, query.Query, query.ScanID, query.ResponseIP,
+		query.Rcode, query.RA, query.AA, query.TC, query.AnswerCount, query.Answers, query.RTTMs,
+		query.RequestSize, query.ResponseSize, query.Amplification)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func insertResolver(db *sqlx.DB, resolver *Resolver) {
+	_, err := db.Exec(`INSERT INTO resolvers (timestamp, scan_id, ip, response_ip, classification, rcode, ra, aa, correct, rtt_ms, version_bind, id_server, hostname_bind,
+		max_amplification, tampering)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		resolver.Timestamp, resolver.ScanID, resolver.Ip, resolver.ResponseIP, resolver.Classification, resolver.Rcode,
+		resolver.RA, resolver.AA, resolver.Correct, resolver.RTTMs, resolver.VersionBind, resolver.IDServer, resolver.HostnameBind,
+		resolver.MaxAmplification, resolver.Tampering)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func insertVerdict(db *sqlx.DB, verdict TamperVerdict) {
+	_, err := db.Exec(`INSERT INTO tamper_verdicts (timestamp, scan_id, ip, name, check_type, verdict, rcode, answers, expected, ttl, expected_ttl, rtt_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		verdict.Timestamp, verdict.ScanID, verdict.Ip, verdict.Name, verdict.CheckType, verdict.Verdict, verdict.Rcode,
+		verdict.Answers, verdict.Expected, verdict.TTL, verdict.ExpectedTTL, verdict.RTTMs)
 	if err != nil {
 		panic(err)
 	}
 }
 
-func inc(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		ip[j]++
-		if ip[j] > 0 {
-			break
+// initDB creates the tables, adding the columns added since to databases
+// created by earlier versions.
+func initDB(db *sqlx.DB) error {
+	for _, schema := range []string{schema, scansSchema, resolversSchema, tamperSchema} {
+		if _, err := db.Exec(schema); err != nil {
+			return err
 		}
 	}
+
+	if err := sqliteutil.AddMissingColumns(db.DB, "dns_queries", queryColumns); err != nil {
+		return err
+	}
+	return sqliteutil.AddMissingColumns(db.DB, "resolvers", resolverColumns)
 }
 
-func dnsQuestionToString(q dns.Question) string {
-	return fmt.Sprintf("%s %s", q.Name, dns.TypeToString[q.Qtype])
+// readSpecs combines targets from a comma-separated flag and a file, with
+// @file references expanded so that a resumed scan does not depend on them.
+func readSpecs(list, path string) ([]string, error) {
+	specs := []string{list}
+	if path != "" {
+		specs = append(specs, "@"+path)
+	}
+	return target.Expand(specs)
 }
 
-func dnsRRToString(rr []dns.RR) string {
-	var str string
-	for _, r := range rr {
-		str += r.String() + "\n"
+// splitLines splits a stored list, which is empty for an empty string.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
 	}
-	return str
+	return strings.Split(s, "\n")
+}
+
+func dnsQuestionToString(q dns.Question) string {
+	return fmt.Sprintf("%s %s", q.Name, dns.TypeToString[q.Qtype])
 }
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/clwg/netsecutils/pkg/dnsrecord"
+	"github.com/clwg/netsecutils/pkg/ratelimit"
+	"github.com/miekg/dns"
+)
+
+// Classifications of a responding address.
+const (
+	ClassOpenResolver  = "open_resolver" // recursion available, answered from the queried address
+	ClassForwarder     = "forwarder"     // answered from a different address
+	ClassRefused       = "refused"
+	ClassServfail      = "servfail"
+	ClassAuthoritative = "authoritative" // authoritative answer or referral without recursion
+	ClassMiddlebox     = "middlebox"     // speaks DNS but the response is malformed or inconsistent
+	ClassUnknown       = "unknown"
+)
+
+// errMalformed is returned for responses that cannot be parsed.
+var errMalformed = errors.New("malformed response")
+
+// chaosNames are the CHAOS class TXT names used to fingerprint DNS software.
+var chaosNames = []string{"version.bind.", "id.server.", "hostname.bind."}
+
+const resolversSchema = `
+CREATE TABLE IF NOT EXISTS resolvers (
+    timestamp TIMESTAMP,
+    scan_id INTEGER,
+    ip TEXT,
+    response_ip TEXT,
+    classification TEXT,
+    rcode TEXT,
+    ra BOOLEAN,
+    aa BOOLEAN,
+    correct BOOLEAN,
+    rtt_ms REAL,
+    version_bind TEXT,
+    id_server TEXT,
+    hostname_bind TEXT,
+    max_amplification REAL,
+    tampering TEXT
+);
+`
+
+// resolverColumns are the resolvers columns added since the table was
+// introduced.
+var resolverColumns = [][2]string{
+	{"max_amplification", "REAL"},
+	{"tampering", "TEXT"},
+}
+
+// Resolver is the classification and fingerprint of a responding address.
+type Resolver struct {
+	Timestamp      time.Time
+	ScanID         int64
+	Ip             string
+	ResponseIP     string
+	Classification string
+	Rcode          string
+	RA             bool
+	AA             bool
+	Correct        *bool `json:",omitempty"` // answer matched -expect, unset without -expect
+	RTTMs          float64
+	VersionBind    string `json:",omitempty"`
+	IDServer       string `json:",omitempty"`
+	HostnameBind   string `json:",omitempty"`
+	// MaxAmplification is the largest response to request size ratio seen
+	// when measuring amplification.
+	MaxAmplification float64 `json:",omitempty"`
+	// Tampering summarizes the tampering checks, "ok" or the findings.
+	Tampering string `json:",omitempty"`
+}
+
+// TargetResult is everything learned about one target.
+type TargetResult struct {
+	Queries  []DnsQuery
+	Resolver *Resolver
+	Verdicts []TamperVerdict
+}
+
+// Scanner queries targets and classifies the responders.
+type Scanner struct {
+	Timeout     time.Duration
+	Limiter     *ratelimit.Limiter
+	Domain      string
+	Domains     []string
+	QTypes      []uint16 // types queried for each domain, the first classifies
+	Expect      []string // expected answers to Domain, checked when set
+	Fingerprint bool     // send CHAOS queries to responders
+	ScanID      int64
+
+	Amplification bool     // measure amplification of open resolvers
+	AmpNames      []string // names queried when measuring amplification
+	AmpTypes      []uint16 // query types sent for each name
+	EDNSSize      uint16   // EDNS0 buffer size advertised in amplification queries
+
+	Tamper *TamperCheck // compare answers with ground truth, nil disables
+}
+
+// Scan queries ip and returns the results, which are empty when the target
+// did not respond.
+func (s *Scanner) Scan(ip net.IP) TargetResult {
+	var result TargetResult
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(s.Domain), s.QTypes[0])
+	r, err := s.exchange(ip, msg)
+	if r == nil {
+		return result
+	}
+
+	resolver := &Resolver{
+		Timestamp:      time.Now(),
+		ScanID:         s.ScanID,
+		Ip:             ip.String(),
+		ResponseIP:     r.From.String(),
+		Classification: classify(ip, msg, r.Msg, r.From),
+		RTTMs:          float64(r.RTT.Microseconds()) / 1000,
+	}
+	result.Resolver = resolver
+	if err != nil {
+		return result
+	}
+
+	resp := r.Msg
+
+	resolver.Rcode = dns.RcodeToString[resp.Rcode]
+	resolver.RA = resp.RecursionAvailable
+	resolver.AA = resp.Authoritative
+	if len(s.Expect) > 0 {
+		correct := answerMatches(resp, s.Expect)
+		resolver.Correct = &correct
+	}
+	result.Queries = append(result.Queries, s.newQuery(ip, s.Domain, msg, r))
+
+	if resp.Rcode == dns.RcodeSuccess {
+		for i, domain := range append([]string{s.Domain}, s.Domains...) {
+			for j, qtype := range s.QTypes {
+				if i == 0 && j == 0 {
+					continue // the classification query
+				}
+				msg := new(dns.Msg)
+				msg.SetQuestion(dns.Fqdn(domain), qtype)
+				r, err := s.exchange(ip, msg)
+				if err != nil {
+					continue
+				}
+				result.Queries = append(result.Queries, s.newQuery(ip, domain, msg, r))
+			}
+		}
+	}
+
+	if s.Amplification && (resolver.Classification == ClassOpenResolver || resolver.Classification == ClassForwarder) {
+		result.Queries = append(result.Queries, s.measureAmplification(ip, resolver)...)
+	}
+
+	if s.Tamper != nil && (resolver.Classification == ClassOpenResolver || resolver.Classification == ClassForwarder) {
+		baseline := r.RTT
+		for _, query := range result.Queries {
+			if rtt := time.Duration(query.RTTMs * float64(time.Millisecond)); rtt < baseline {
+				baseline = rtt
+			}
+		}
+		result.Verdicts = s.checkTampering(ip, baseline)
+		resolver.Tampering = summarizeVerdicts(result.Verdicts)
+	}
+
+	if s.Fingerprint {
+		s.fingerprint(ip, resolver)
+	}
+	return result
+}
+
+// fingerprint records the answers to the CHAOS identification queries.
+func (s *Scanner) fingerprint(ip net.IP, resolver *Resolver) {
+	fields := []*string{&resolver.VersionBind, &resolver.IDServer, &resolver.HostnameBind}
+	for i, name := range chaosNames {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeTXT)
+		msg.Question[0].Qclass = dns.ClassCHAOS
+		r, err := s.exchange(ip, msg)
+		if err != nil || r.Msg.Rcode != dns.RcodeSuccess {
+			continue
+		}
+		var values []string
+		for _, rr := range r.Msg.Answer {
+			if txt, ok := rr.(*dns.TXT); ok {
+				values = append(values, strings.Join(txt.Txt, ""))
+			}
+		}
+		*fields[i] = strings.Join(values, " ")
+	}
+}
+
+// reply is a response received by exchange.
+type reply struct {
+	Msg         *dns.Msg // nil if the response could not be parsed
+	From        net.IP
+	RTT         time.Duration
+	RequestSize int
+	Size        int
+}
+
+// exchange sends msg to ip over UDP and returns the first response with a
+// matching ID from any address, so that replies sent from another address,
+// as some forwarders do, are seen. A response that cannot be parsed is
+// returned with errMalformed.
+func (s *Scanner) exchange(ip net.IP, msg *dns.Msg) (*reply, error) {
+	s.Limiter.Wait()
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if _, err := conn.WriteTo(packed, &net.UDPAddr{IP: ip, Port: 53}); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(start.Add(s.Timeout))
+
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		r := &reply{
+			From:        addr.(*net.UDPAddr).IP,
+			RTT:         time.Since(start),
+			RequestSize: len(packed),
+			Size:        n,
+		}
+
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf[:n]); err != nil {
+			// Only an address we queried can be blamed for garbage.
+			if r.From.Equal(ip) {
+				return r, errMalformed
+			}
+			continue
+		}
+		if resp.Id != msg.Id {
+			continue
+		}
+		r.Msg = resp
+		return r, nil
+	}
+}
+
+// newQuery returns the dns_queries row for a query and its reply.
+func (s *Scanner) newQuery(ip net.IP, domain string, msg *dns.Msg, r *reply) DnsQuery {
+	resp := r.Msg
+	return DnsQuery{
+		Timestamp:     time.Now(),
+		Ip:            ip.String(),
+		ResponseIP:    r.From.String(),
+		Domain:        domain,
+		Query:         dnsQuestionToString(msg.Question[0]),
+		Rcode:         dns.RcodeToString[resp.Rcode],
+		RA:            resp.RecursionAvailable,
+		AA:            resp.Authoritative,
+		TC:            resp.Truncated,
+		AnswerCount:   len(resp.Answer),
+		Answers:       dnsrecord.RdataString(resp.Answer),
+		RTTMs:         float64(r.RTT.Microseconds()) / 1000,
+		RequestSize:   r.RequestSize,
+		ResponseSize:  r.Size,
+		Amplification: float64(r.Size) / float64(r.RequestSize),
+		ScanID:        s.ScanID,
+	}
+}
+
+// classify determines what kind of server sent resp in reply to msg.
+func classify(ip net.IP, msg, resp *dns.Msg, from net.IP) string {
+	switch {
+	case resp == nil:
+		return ClassMiddlebox
+	case !from.Equal(ip):
+		return ClassForwarder
+	case !resp.Response || len(resp.Question) != 1 ||
+		!strings.EqualFold(resp.Question[0].Name, msg.Question[0].Name) ||
+		resp.Question[0].Qtype != msg.Question[0].Qtype:
+		return ClassMiddlebox
+	case resp.Rcode == dns.RcodeRefused:
+		return ClassRefused
+	case resp.Rcode == dns.RcodeServerFailure:
+		return ClassServfail
+	case resp.RecursionAvailable && (resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError):
+		return ClassOpenResolver
+	case resp.Authoritative || (len(resp.Answer) == 0 && hasReferral(resp)):
+		return ClassAuthoritative
+	case len(resp.Answer) > 0:
+		// Answers without recursion or authority come from devices
+		// answering on behalf of something else.
+		return ClassMiddlebox
+	default:
+		return ClassUnknown
+	}
+}
+
+// hasReferral reports whether the authority section holds NS records.
+func hasReferral(resp *dns.Msg) bool {
+	for _, rr := range resp.Ns {
+		if rr.Header().Rrtype == dns.TypeNS {
+			return true
+		}
+	}
+	return false
+}
+
+// answerMatches reports whether resp holds address records and all of them
+// are among expect.
+func answerMatches(resp *dns.Msg, expect []string) bool {
+	found := false
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if !containsAddress(expect, ip) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// containsAddress reports whether ip is in the list of addresses.
+func containsAddress(list []string, ip net.IP) bool {
+	for _, entry := range list {
+		if ip.Equal(net.ParseIP(entry)) {
+			return true
+		}
+	}
+	return false
+}
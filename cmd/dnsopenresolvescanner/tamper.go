@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Findings of the tampering checks.
+const (
+	FindingInjected        = "injected"         // answers not given by the ground truth resolver
+	FindingMissing         = "missing"          // no answer where the ground truth has one
+	FindingNXDomainRewrite = "nxdomain_rewrite" // answers for a name that does not exist
+	FindingTTLAnomaly      = "ttl_anomaly"      // TTL above the authoritative TTL
+	FindingFastResponse    = "fast_response"    // answered faster than possible
+)
+
+const tamperSchema = `
+CREATE TABLE IF NOT EXISTS tamper_verdicts (
+    timestamp TIMESTAMP,
+    scan_id INTEGER,
+    ip TEXT,
+    name TEXT,
+    check_type TEXT,
+    verdict TEXT,
+    rcode TEXT,
+    answers TEXT,
+    expected TEXT,
+    ttl INTEGER,
+    expected_ttl INTEGER,
+    rtt_ms REAL
+);
+`
+
+// TamperVerdict is the outcome of one tampering check against a resolver.
+type TamperVerdict struct {
+	Timestamp   time.Time
+	ScanID      int64
+	Ip          string
+	Name        string
+	CheckType   string // control or nxdomain
+	Verdict     string // "ok" or comma-separated findings
+	Rcode       string
+	Answers     string
+	Expected    string
+	TTL         uint32
+	ExpectedTTL uint32 // authoritative TTL, 0 when unknown
+	RTTMs       float64
+}
+
+// controlName is a name with answers known from the ground truth resolver.
+type controlName struct {
+	Name    string
+	Rcode   int
+	Answers []string
+	TTL     uint32 // authoritative TTL, 0 when it could not be determined
+}
+
+// TamperCheck compares answers from scanned resolvers with a trusted ground
+// truth resolver.
+type TamperCheck struct {
+	Controls []controlName
+	NXZone   string        // zone under which random nonexistent names are queried
+	NXCount  int           // number of nonexistent names queried per resolver
+	MinRTT   time.Duration // answers faster than this are implausible, 0 disables
+}
+
+// newTamperCheck resolves the control names through the ground truth
+// resolver and verifies that random names under nxZone do not exist.
+func newTamperCheck(groundTruth string, names []string, nxZone string, nxCount int, minRTT, timeout time.Duration) (*TamperCheck, error) {
+	client := &dns.Client{Timeout: timeout}
+	check := &TamperCheck{NXZone: dns.Fqdn(nxZone), NXCount: nxCount, MinRTT: minRTT}
+
+	for _, name := range names {
+		resp, err := query(client, groundTruth, dns.Fqdn(name), dns.TypeA, true)
+		if err != nil {
+			return nil, fmt.Errorf("ground truth %s: %w", name, err)
+		}
+		control := controlName{
+			Name:    dns.Fqdn(name),
+			Rcode:   resp.Rcode,
+			Answers: addressStrings(resp.Answer),
+			TTL:     authoritativeTTL(client, groundTruth, dns.Fqdn(name)),
+		}
+		check.Controls = append(check.Controls, control)
+	}
+
+	resp, err := query(client, groundTruth, randomLabel()+"."+check.NXZone, dns.TypeA, true)
+	if err != nil {
+		return nil, fmt.Errorf("ground truth %s: %w", check.NXZone, err)
+	}
+	if resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("random names under %s are not NXDOMAIN at the ground truth resolver, pick another -nx-zone", check.NXZone)
+	}
+	return check, nil
+}
+
+// checkTampering runs the control and nonexistent name checks against ip.
+// baseline is the fastest response seen from ip, at least one network round
+// trip, which an uncached recursive answer cannot beat.
+func (s *Scanner) checkTampering(ip net.IP, baseline time.Duration) []TamperVerdict {
+	var verdicts []TamperVerdict
+
+	for _, control := range s.Tamper.Controls {
+		msg := new(dns.Msg)
+		msg.SetQuestion(control.Name, dns.TypeA)
+		r, err := s.exchange(ip, msg)
+		if err != nil {
+			continue
+		}
+
+		verdict := s.newVerdict(ip, control.Name, "control", r)
+		verdict.Expected = strings.Join(control.Answers, ",")
+		verdict.ExpectedTTL = control.TTL
+
+		var findings []string
+		answers := addressStrings(r.Msg.Answer)
+		switch {
+		case len(answers) == 0 && len(control.Answers) > 0:
+			findings = append(findings, FindingMissing)
+		case len(answers) > 0 && !subset(answers, control.Answers):
+			findings = append(findings, FindingInjected)
+		}
+		if control.TTL > 0 && verdict.TTL > control.TTL {
+			findings = append(findings, FindingTTLAnomaly)
+		}
+		if s.Tamper.MinRTT > 0 && r.RTT < s.Tamper.MinRTT {
+			findings = append(findings, FindingFastResponse)
+		}
+		verdict.Verdict = verdictString(findings)
+		verdicts = append(verdicts, verdict)
+	}
+
+	for i := 0; i < s.Tamper.NXCount; i++ {
+		name := randomLabel() + "." + s.Tamper.NXZone
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		r, err := s.exchange(ip, msg)
+		if err != nil {
+			continue
+		}
+
+		verdict := s.newVerdict(ip, name, "nxdomain", r)
+		verdict.Expected = dns.RcodeToString[dns.RcodeNameError]
+
+		var findings []string
+		if len(r.Msg.Answer) > 0 {
+			findings = append(findings, FindingNXDomainRewrite)
+		}
+		// The name cannot be cached, so a genuine answer needs a round
+		// trip to us plus one from the resolver to the authoritative
+		// servers. Half the baseline leaves room for jitter and for
+		// names synthesized from cached NSEC records (RFC 8198).
+		if r.RTT < baseline/2 || (s.Tamper.MinRTT > 0 && r.RTT < s.Tamper.MinRTT) {
+			findings = append(findings, FindingFastResponse)
+		}
+		verdict.Verdict = verdictString(findings)
+		verdicts = append(verdicts, verdict)
+	}
+	return verdicts
+}
+
+// newVerdict returns a verdict holding the response fields of r.
+func (s *Scanner) newVerdict(ip net.IP, name, checkType string, r *reply) TamperVerdict {
+	verdict := TamperVerdict{
+		Timestamp: time.Now(),
+		ScanID:    s.ScanID,
+		Ip:        ip.String(),
+		Name:      name,
+		CheckType: checkType,
+		Rcode:     dns.RcodeToString[r.Msg.Rcode],
+		Answers:   strings.Join(addressStrings(r.Msg.Answer), ","),
+		RTTMs:     float64(r.RTT.Microseconds()) / 1000,
+	}
+	for _, rr := range r.Msg.Answer {
+		if ttl := rr.Header().Ttl; ttl > verdict.TTL {
+			verdict.TTL = ttl
+		}
+	}
+	return verdict
+}
+
+// summarizeVerdicts returns the distinct findings of a resolver's verdicts,
+// or "ok".
+func summarizeVerdicts(verdicts []TamperVerdict) string {
+	seen := make(map[string]bool)
+	var findings []string
+	for _, verdict := range verdicts {
+		if verdict.Verdict == "ok" {
+			continue
+		}
+		for _, finding := range strings.Split(verdict.Verdict, ",") {
+			if !seen[finding] {
+				seen[finding] = true
+				findings = append(findings, finding)
+			}
+		}
+	}
+	sort.Strings(findings)
+	return verdictString(findings)
+}
+
+// verdictString joins findings, returning "ok" when there are none.
+func verdictString(findings []string) string {
+	if len(findings) == 0 {
+		return "ok"
+	}
+	return strings.Join(findings, ",")
+}
+
+// authoritativeTTL returns the TTL of name's A records as served by one of
+// its zone's name servers, found through the ground truth resolver. Resolvers
+// count cached TTLs down from this value, so a higher TTL was not learned
+// from the zone. It returns 0 when the TTL cannot be determined.
+func authoritativeTTL(client *dns.Client, groundTruth, name string) uint32 {
+	resp, err := query(client, groundTruth, name, dns.TypeSOA, true)
+	if err != nil {
+		return 0
+	}
+	zone := ""
+	for _, rr := range append(resp.Answer, resp.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			zone = soa.Hdr.Name
+			break
+		}
+	}
+	if zone == "" {
+		return 0
+	}
+
+	resp, err = query(client, groundTruth, zone, dns.TypeNS, true)
+	if err != nil {
+		return 0
+	}
+	for _, rr := range resp.Answer {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		addrs, err := query(client, groundTruth, ns.Ns, dns.TypeA, true)
+		if err != nil || len(addressStrings(addrs.Answer)) == 0 {
+			continue
+		}
+		server := net.JoinHostPort(addressStrings(addrs.Answer)[0], "53")
+		resp, err := query(client, server, name, dns.TypeA, false)
+		if err != nil || !resp.Authoritative {
+			continue
+		}
+		var ttl uint32
+		for _, rr := range resp.Answer {
+			if rr.Header().Rrtype == dns.TypeA && rr.Header().Ttl > ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		return ttl
+	}
+	return 0
+}
+
+// query sends a single question to server.
+func query(client *dns.Client, server, name string, qtype uint16, recursive bool) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	msg.RecursionDesired = recursive
+	resp, _, err := client.Exchange(msg, server)
+	return resp, err
+}
+
+// addressStrings returns the addresses of the A and AAAA records in rrs,
+// sorted.
+func addressStrings(rrs []dns.RR) []string {
+	var addrs []string
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, rr.A.String())
+		case *dns.AAAA:
+			addrs = append(addrs, rr.AAAA.String())
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// subset reports whether every element of a is in b.
+func subset(a, b []string) bool {
+	set := make(map[string]bool, len(b))
+	for _, s := range b {
+		set[s] = true
+	}
+	for _, s := range a {
+		if !set[s] {
+			return false
+		}
+	}
+	return true
+}
+
+// randomLabel returns a random label for names that do not exist.
+func randomLabel() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/clwg/netsecutils/pkg/probename"
+)
+
+// GraphNode is a target network or egress resolver.
+type GraphNode struct {
+	ID   string
+	Type string // "network" or "egress"
+}
+
+// GraphEdge links a target network to an egress resolver serving it.
+type GraphEdge struct {
+	Source  string
+	Target  string
+	Targets int // targets of the network served by the resolver
+}
+
+// Graph is the bipartite graph of target networks and egress resolvers.
+type Graph struct {
+	Nodes []GraphNode
+	Edges []GraphEdge
+}
+
+func main() {
+	probeFiles := flag.String("probes", "", "Comma-separated dnsforwardingmapper databases (.db) or JSON log files and directories")
+	queryFiles := flag.String("queries", "", "Comma-separated dnsauthsink databases (.db) or JSON log files and directories")
+	zone := flag.String("zone", "", "Probe zone the names were generated under")
+	encoding := flag.String("encoding", "plain", "Encoding of the target address in probe names: plain, dictionary or keyed")
+	dictionary := flag.String("dictionary", "dictionary.txt", "ipcipher dictionary file for dictionary encoding")
+	key := flag.String("key", "", "ipcipher passphrase for keyed encoding")
+	scanID := flag.String("scan-id", "", "Only report this scan")
+	v4Bits := flag.Int("v4-prefix", 24, "Prefix length grouping IPv4 targets into networks")
+	v6Bits := flag.Int("v6-prefix", 48, "Prefix length grouping IPv6 targets into networks")
+	format := flag.String("format", "text", "Output format: text, json, graph-json or dot")
+	output := flag.String("output", "", "Output file (default: stdout)")
+	flag.Parse()
+
+	if *zone == "" || *queryFiles == "" {
+		log.Fatal("-zone and -queries are required")
+	}
+
+	enc, err := probename.ParseEncoding(*encoding)
+	if err != nil {
+		log.Fatal(err)
+	}
+	codec, err := probename.NewCodec(*zone, enc, *dictionary, *key)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	probes, err := loadProbes(splitList(*probeFiles))
+	if err != nil {
+		log.Fatal(err)
+	}
+	queries, err := loadQueries(splitList(*queryFiles), strings.TrimSuffix(codec.Zone, "."))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	correlator := &Correlator{Codec: codec, ScanID: *scanID, V4Bits: *v4Bits, V6Bits: *v6Bits}
+	report := correlator.Correlate(probes, queries)
+	log.Printf("%d probes, %d queries (%d undecodable), %d paths", report.Probes, report.Queries, report.Undecoded, len(report.Paths))
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	switch *format {
+	case "text":
+		err = writeText(w, report)
+	case "json":
+		err = writeJSON(w, report)
+	case "graph-json":
+		err = writeJSON(w, newGraph(report))
+	case "dot":
+		err = writeDot(w, newGraph(report))
+	default:
+		log.Fatalf("Unknown format %q", *format)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newGraph returns the graph of target networks and their egress resolvers.
+func newGraph(report *Report) *Graph {
+	graph := &Graph{}
+	for _, egress := range report.Egress {
+		graph.Nodes = append(graph.Nodes, GraphNode{ID: egress.Resolver, Type: "egress"})
+	}
+	for _, network := range report.Networks {
+		graph.Nodes = append(graph.Nodes, GraphNode{ID: network.Network, Type: "network"})
+		for _, share := range network.Egress {
+			graph.Edges = append(graph.Edges, GraphEdge{Source: network.Network, Target: share.Resolver, Targets: share.Targets})
+		}
+	}
+	return graph
+}
+
+// writeText writes the paths and summaries as tables.
+func writeText(w io.Writer, report *Report) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "TARGET\tEGRESS\tCLIENT SUBNET\tDELAY MS\tQUERIES\tDUPLICATES\tPROBED")
+	for _, path := range report.Paths {
+		delay := "-"
+		if path.DelayMs != nil {
+			delay = fmt.Sprintf("%.1f", *path.DelayMs)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%t\n", path.Target, path.Egress, orDash(strings.Join(path.ClientSubnets, ",")),
+			delay, path.Queries, path.Duplicates, path.Probed)
+	}
+
+	fmt.Fprintln(tw, "\nNETWORK\tPROBED\tREACHED\tEGRESS RESOLVERS")
+	for _, network := range report.Networks {
+		var egress []string
+		for _, share := range network.Egress {
+			egress = append(egress, fmt.Sprintf("%s (%d)", share.Resolver, share.Targets))
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", network.Network, network.Probed, network.Reached, orDash(strings.Join(egress, ", ")))
+	}
+
+	fmt.Fprintln(tw, "\nEGRESS\tTARGETS\tNETWORKS\tCLIENT SUBNETS")
+	for _, egress := range report.Egress {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", egress.Resolver, egress.Targets, strings.Join(egress.Networks, ","),
+			orDash(strings.Join(egress.ClientSubnets, ",")))
+	}
+	return tw.Flush()
+}
+
+// writeJSON writes v as indented JSON.
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// writeDot writes the graph in Graphviz DOT format, edges weighted by the
+// number of targets.
+func writeDot(w io.Writer, graph *Graph) error {
+	var b strings.Builder
+	b.WriteString("digraph forwarding {\n  rankdir=LR;\n")
+	for _, node := range graph.Nodes {
+		shape := "box"
+		if node.Type == "egress" {
+			shape = "ellipse"
+		}
+		fmt.Fprintf(&b, "  %q [shape=%s];\n", node.ID, shape)
+	}
+	for _, edge := range graph.Edges {
+		fmt.Fprintf(&b, "  %q -> %q [label=\"%d\", weight=%d];\n", edge.Source, edge.Target, edge.Targets, edge.Targets)
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// orDash returns s, or "-" when it is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// splitList splits a comma-separated flag value.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
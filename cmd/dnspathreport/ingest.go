@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ProbeRecord is a probe sent by dnsforwardingmapper.
+type ProbeRecord struct {
+	Timestamp time.Time
+	ScanID    string
+	Target    string
+	QName     string
+}
+
+// ReceivedQuery is a query received by dnsauthsink.
+type ReceivedQuery struct {
+	Timestamp    time.Time
+	SourceIP     string
+	QName        string
+	QType        string
+	ClientSubnet string
+}
+
+// logLine holds the fields of the JSON log lines written by dnsauthsink
+// (DNSQuery) and dnsforwardingmapper (Probe); other lines are ignored.
+type logLine struct {
+	Timestamp time.Time
+
+	SourceIP string
+	Query    string
+	QType    string
+	EDNS     *struct {
+		ClientSubnet string
+	}
+
+	ScanID string
+	Target string
+	QName  string
+}
+
+// isSQLite reports whether path names a SQLite database.
+func isSQLite(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".db", ".sqlite", ".sqlite3":
+		return true
+	}
+	return false
+}
+
+// loadProbes reads probe records from mapper databases or JSON logs.
+func loadProbes(paths []string) ([]ProbeRecord, error) {
+	var probes []ProbeRecord
+	for _, path := range paths {
+		if isSQLite(path) {
+			records, err := readProbesDB(path)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			probes = append(probes, records...)
+			continue
+		}
+
+		err := readLogs(path, func(line logLine) {
+			if line.QName != "" && line.Target != "" {
+				probes = append(probes, ProbeRecord{
+					Timestamp: line.Timestamp,
+					ScanID:    line.ScanID,
+					Target:    line.Target,
+					QName:     line.QName,
+				})
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return probes, nil
+}
+
+// loadQueries reads queries for names under zone, given without the trailing
+// dot, from sink databases or JSON logs.
+func loadQueries(paths []string, zone string) ([]ReceivedQuery, error) {
+	var queries []ReceivedQuery
+	for _, path := range paths {
+		if isSQLite(path) {
+			records, err := readQueriesDB(path, zone)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			queries = append(queries, records...)
+			continue
+		}
+
+		err := readLogs(path, func(line logLine) {
+			if line.Query == "" || line.SourceIP == "" || line.QType == "" {
+				return
+			}
+			if !inZone(line.Query, zone) {
+				return
+			}
+			query := ReceivedQuery{
+				Timestamp: line.Timestamp,
+				SourceIP:  line.SourceIP,
+				QName:     line.Query,
+				QType:     line.QType,
+			}
+			if line.EDNS != nil {
+				query.ClientSubnet = line.EDNS.ClientSubnet
+			}
+			queries = append(queries, query)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return queries, nil
+}
+
+// readProbesDB reads the probes table of a dnsforwardingmapper database.
+func readProbesDB(path string) ([]ProbeRecord, error) {
+	db, err := sql.Open("sqlite3", path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT timestamp, COALESCE(scan_id, ''), target, qname FROM probes")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var probes []ProbeRecord
+	for rows.Next() {
+		var p ProbeRecord
+		if err := rows.Scan(&p.Timestamp, &p.ScanID, &p.Target, &p.QName); err != nil {
+			return nil, err
+		}
+		probes = append(probes, p)
+	}
+	return probes, rows.Err()
+}
+
+// readQueriesDB reads the dns_queries table of a dnsauthsink database.
+func readQueriesDB(path, zone string) ([]ReceivedQuery, error) {
+	db, err := sql.Open("sqlite3", path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT timestamp, source_ip, qname, COALESCE(qtype, ''), COALESCE(client_subnet, '')
+		FROM dns_queries WHERE rtrim(lower(qname), '.') = ? OR rtrim(lower(qname), '.') LIKE ? ESCAPE '\'`,
+		zone, "%."+escapeLike(zone))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var queries []ReceivedQuery
+	for rows.Next() {
+		var q ReceivedQuery
+		if err := rows.Scan(&q.Timestamp, &q.SourceIP, &q.QName, &q.QType, &q.ClientSubnet); err != nil {
+			return nil, err
+		}
+		queries = append(queries, q)
+	}
+	return queries, rows.Err()
+}
+
+// inZone reports whether name is zone or a name under it. zone is lower case
+// without the trailing dot.
+func inZone(name, zone string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern, with \ as the escape
+// character.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// readLogs calls fn for each line of a JSON log file, or of every log file
+// under a directory. Gzipped archives (.gz) are decompressed.
+func readLogs(path string, fn func(logLine)) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return readLogFile(path, fn)
+	}
+
+	return filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		name := strings.TrimSuffix(entry.Name(), ".gz")
+		if ext := filepath.Ext(name); ext != ".log" && ext != ".jsonl" && ext != ".json" {
+			return nil
+		}
+		return readLogFile(file, fn)
+	})
+}
+
+// readLogFile calls fn for each JSON line of a file.
+func readLogFile(path string, fn func(logLine)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var line logLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			continue
+		}
+		fn(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
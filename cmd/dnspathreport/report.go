@@ -0,0 +1,270 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/clwg/netsecutils/pkg/probename"
+	"github.com/miekg/dns"
+)
+
+// PathRecord is the forwarding path from a probed target to an egress
+// resolver, the address the sink received the target's queries from.
+type PathRecord struct {
+	Target        string
+	Egress        string
+	ScanID        string   `json:",omitempty"`
+	ClientSubnets []string `json:",omitempty"` // EDNS client subnets sent by the egress resolver
+	Queries       int      // queries received for the target's names
+	Duplicates    int      // queries beyond the first for each name and type
+	DelayMs       *float64 `json:",omitempty"` // first arrival minus the send time, nil when the send time is unknown
+	FirstSeen     time.Time
+	LastSeen      time.Time
+	Probed        bool // a probe record exists for the target
+}
+
+// EgressShare is the number of targets of a network served by one egress
+// resolver.
+type EgressShare struct {
+	Resolver string
+	Targets  int
+}
+
+// NetworkSummary lists the egress resolvers serving the targets of a
+// network.
+type NetworkSummary struct {
+	Network string
+	Probed  int // targets with probe records
+	Reached int // targets whose queries arrived at the sink
+	Egress  []EgressShare
+}
+
+// EgressSummary lists the target networks served by an egress resolver.
+type EgressSummary struct {
+	Resolver      string
+	Targets       int
+	Networks      []string
+	ClientSubnets []string `json:",omitempty"`
+}
+
+// Report is the correlation of probes with the queries they caused.
+type Report struct {
+	Probes    int // probe records read
+	Queries   int // queries read under the probe zone
+	Undecoded int // queries whose names could not be decoded
+	Paths     []PathRecord
+	Networks  []NetworkSummary
+	Egress    []EgressSummary
+}
+
+// Correlator joins probe records and received queries.
+type Correlator struct {
+	Codec  *probename.Codec
+	ScanID string // only correlate this scan, all scans when empty
+	V4Bits int    // prefix length of IPv4 target networks
+	V6Bits int    // prefix length of IPv6 target networks
+}
+
+// pathKey identifies a forwarding path.
+type pathKey struct {
+	target, egress string
+}
+
+// Correlate builds the report. Probe records supply the send time of their
+// names; names without one fall back to the timestamp encoded in the name.
+func (c *Correlator) Correlate(probes []ProbeRecord, queries []ReceivedQuery) *Report {
+	report := &Report{Queries: len(queries)}
+
+	sent := make(map[string]time.Time)
+	probed := make(map[string]bool)
+	for _, p := range probes {
+		if c.ScanID != "" && p.ScanID != c.ScanID {
+			continue
+		}
+		report.Probes++
+		probed[p.Target] = true
+		name := strings.ToLower(dns.Fqdn(p.QName))
+		if t, ok := sent[name]; !ok || p.Timestamp.Before(t) {
+			sent[name] = p.Timestamp
+		}
+	}
+
+	paths := make(map[pathKey]*PathRecord)
+	seen := make(map[pathKey]map[string]bool)
+	for _, q := range queries {
+		probe, err := c.Codec.Decode(q.QName)
+		if err != nil {
+			report.Undecoded++
+			continue
+		}
+		if c.ScanID != "" && probe.Scan != c.ScanID {
+			continue
+		}
+
+		key := pathKey{target: probe.Target.String(), egress: q.SourceIP}
+		path, ok := paths[key]
+		if !ok {
+			path = &PathRecord{
+				Target:    key.target,
+				Egress:    key.egress,
+				ScanID:    probe.Scan,
+				FirstSeen: q.Timestamp,
+				LastSeen:  q.Timestamp,
+				Probed:    probed[key.target],
+			}
+			paths[key] = path
+			seen[key] = make(map[string]bool)
+		}
+
+		path.Queries++
+		question := strings.ToLower(dns.Fqdn(q.QName)) + "/" + q.QType
+		if seen[key][question] {
+			path.Duplicates++
+		}
+		seen[key][question] = true
+
+		if q.Timestamp.Before(path.FirstSeen) {
+			path.FirstSeen = q.Timestamp
+		}
+		if q.Timestamp.After(path.LastSeen) {
+			path.LastSeen = q.Timestamp
+		}
+		if q.ClientSubnet != "" && !contains(path.ClientSubnets, q.ClientSubnet) {
+			path.ClientSubnets = append(path.ClientSubnets, q.ClientSubnet)
+		}
+
+		sendTime, ok := sent[strings.ToLower(dns.Fqdn(q.QName))]
+		if !ok {
+			sendTime = probe.Timestamp
+		}
+		if !sendTime.IsZero() {
+			delay := float64(q.Timestamp.Sub(sendTime).Microseconds()) / 1000
+			if path.DelayMs == nil || delay < *path.DelayMs {
+				path.DelayMs = &delay
+			}
+		}
+	}
+
+	for _, path := range paths {
+		sort.Strings(path.ClientSubnets)
+		report.Paths = append(report.Paths, *path)
+	}
+	sort.Slice(report.Paths, func(i, j int) bool {
+		a, b := report.Paths[i], report.Paths[j]
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		return a.Egress < b.Egress
+	})
+
+	report.Networks = c.networkSummaries(report.Paths, probed)
+	report.Egress = c.egressSummaries(report.Paths)
+	return report
+}
+
+// networkSummaries groups paths and probed targets by target network.
+func (c *Correlator) networkSummaries(paths []PathRecord, probed map[string]bool) []NetworkSummary {
+	summaries := make(map[string]*NetworkSummary)
+	summary := func(network string) *NetworkSummary {
+		s, ok := summaries[network]
+		if !ok {
+			s = &NetworkSummary{Network: network}
+			summaries[network] = s
+		}
+		return s
+	}
+
+	for target := range probed {
+		summary(c.network(target)).Probed++
+	}
+
+	reached := make(map[string]bool)
+	shares := make(map[pathKey]int)
+	for _, path := range paths {
+		network := c.network(path.Target)
+		s := summary(network)
+		if !reached[path.Target] {
+			reached[path.Target] = true
+			s.Reached++
+		}
+		shares[pathKey{target: network, egress: path.Egress}]++
+	}
+	for key, targets := range shares {
+		s := summaries[key.target]
+		s.Egress = append(s.Egress, EgressShare{Resolver: key.egress, Targets: targets})
+	}
+
+	var result []NetworkSummary
+	for _, s := range summaries {
+		sort.Slice(s.Egress, func(i, j int) bool {
+			if s.Egress[i].Targets != s.Egress[j].Targets {
+				return s.Egress[i].Targets > s.Egress[j].Targets
+			}
+			return s.Egress[i].Resolver < s.Egress[j].Resolver
+		})
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Network < result[j].Network })
+	return result
+}
+
+// egressSummaries groups paths by egress resolver.
+func (c *Correlator) egressSummaries(paths []PathRecord) []EgressSummary {
+	summaries := make(map[string]*EgressSummary)
+	for _, path := range paths {
+		s, ok := summaries[path.Egress]
+		if !ok {
+			s = &EgressSummary{Resolver: path.Egress}
+			summaries[path.Egress] = s
+		}
+		s.Targets++
+		if network := c.network(path.Target); !contains(s.Networks, network) {
+			s.Networks = append(s.Networks, network)
+		}
+		for _, subnet := range path.ClientSubnets {
+			if !contains(s.ClientSubnets, subnet) {
+				s.ClientSubnets = append(s.ClientSubnets, subnet)
+			}
+		}
+	}
+
+	var result []EgressSummary
+	for _, s := range summaries {
+		sort.Strings(s.Networks)
+		sort.Strings(s.ClientSubnets)
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Targets != result[j].Targets {
+			return result[i].Targets > result[j].Targets
+		}
+		return result[i].Resolver < result[j].Resolver
+	})
+	return result
+}
+
+// network returns the target network holding address.
+func (c *Correlator) network(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return address
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ipnet := net.IPNet{IP: ip4.Mask(net.CIDRMask(c.V4Bits, 32)), Mask: net.CIDRMask(c.V4Bits, 32)}
+		return ipnet.String()
+	}
+	ipnet := net.IPNet{IP: ip.Mask(net.CIDRMask(c.V6Bits, 128)), Mask: net.CIDRMask(c.V6Bits, 128)}
+	return ipnet.String()
+}
+
+// contains reports whether list holds s.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/clwg/netsecutils/pkg/ratelimit"
+)
+
+// titlePattern matches the title of an HTML page.
+var titlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// HTTPInfo is the response of an HTTP server to a request for /.
+type HTTPInfo struct {
+	Proto      string      `json:"proto"`
+	StatusCode int         `json:"status_code"`
+	Status     string      `json:"status"`
+	Headers    http.Header `json:"headers"`
+	Title      string      `json:"title,omitempty"`
+}
+
+// BannerGrabber reads banners from open TCP ports over one connection each:
+// it waits for a greeting and sends an HTTP request to services waiting for
+// the client to speak first.
+type BannerGrabber struct {
+	Limiter  *ratelimit.Limiter
+	Timeout  time.Duration // connection timeout
+	Greeting time.Duration // time to wait for a greeting
+	Wait     time.Duration // time to wait for TLS handshakes and HTTP responses
+	MaxBytes int           // bytes of the answer captured
+	Encoding string        // encoding of the captured bytes: base64 or hex
+}
+
+// Grab reads the banner of host:port, over TLS when useTLS is set. serverName,
+// when set, is sent as SNI and as the HTTP Host.
+func (g *BannerGrabber) Grab(host, serverName string, port int, useTLS bool) BannerInfo {
+	info := BannerInfo{Port: port, Protocol: "tcp", Probe: "null", TLS: useTLS}
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+
+	g.Limiter.Wait()
+	start := time.Now()
+	raw, err := net.DialTimeout("tcp", address, g.Timeout)
+	if err != nil {
+		info.Banner = fmt.Sprintf("Error grabbing banner: %v", err)
+		return info
+	}
+	defer raw.Close()
+	info.ConnectMs = milliseconds(time.Since(start))
+
+	conn := raw
+	if useTLS {
+		handshakeStart := time.Now()
+		client := tls.Client(raw, &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         serverName,
+			MinVersion:         tls.VersionTLS10,
+			CipherSuites:       allSuites(),
+			NextProtos:         []string{"http/1.1"},
+		})
+		client.SetDeadline(handshakeStart.Add(g.Wait))
+		if err := client.Handshake(); err != nil {
+			info.Banner = fmt.Sprintf("Error grabbing banner: %v", err)
+			return info
+		}
+		info.TLSMs = milliseconds(time.Since(handshakeStart))
+		conn = client
+	}
+
+	sent := time.Now()
+	answer, first := readAnswer(conn, g.Greeting, g.MaxBytes)
+	if len(answer) == 0 {
+		info.Probe = "http"
+		conn.SetWriteDeadline(time.Now().Add(g.Wait))
+		sent = time.Now()
+		hostHeader := address
+		if serverName != "" {
+			hostHeader = net.JoinHostPort(serverName, strconv.Itoa(port))
+		}
+		_, err = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", hostHeader)
+		if err == nil {
+			answer, first = readAnswer(conn, g.Wait, g.MaxBytes)
+		}
+	}
+	info.TotalMs = milliseconds(time.Since(start))
+	if len(answer) == 0 {
+		if err == nil {
+			err = fmt.Errorf("no banner received")
+		}
+		info.Banner = fmt.Sprintf("Error grabbing banner: %v", err)
+		return info
+	}
+	info.FirstByteMs = milliseconds(first.Sub(sent))
+	info.Raw, info.RawEncoding = g.encode(answer), g.Encoding
+
+	if info.HTTP = parseHTTP(answer); info.HTTP != nil {
+		info.Banner = info.HTTP.Headers.Get("Server")
+		if info.Banner == "" {
+			info.Banner = info.HTTP.Proto + " " + info.HTTP.Status
+		}
+	} else {
+		line, _, _ := strings.Cut(string(answer), "\n")
+		info.Banner = printable([]byte(strings.TrimRight(line, "\r")))
+	}
+	return info
+}
+
+// udpBanner returns the banner of a UDP port from the answer to its probe.
+func (g *BannerGrabber) udpBanner(result PortResult) BannerInfo {
+	answer := result.Response
+	if len(answer) > g.MaxBytes {
+		answer = answer[:g.MaxBytes]
+	}
+	return BannerInfo{
+		Port:        result.Port,
+		Protocol:    "udp",
+		Service:     result.Service,
+		Banner:      printable(answer),
+		Raw:         g.encode(answer),
+		RawEncoding: g.Encoding,
+		TotalMs:     milliseconds(result.RTT),
+	}
+}
+
+// encode returns b in the grabber's encoding.
+func (g *BannerGrabber) encode(b []byte) string {
+	if g.Encoding == "hex" {
+		return hex.EncodeToString(b)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// parseHTTP parses answer as an HTTP response, returning nil for other
+// answers. The body may be truncated, and is only searched for a title.
+func parseHTTP(answer []byte) *HTTPInfo {
+	if !bytes.HasPrefix(answer, []byte("HTTP/")) {
+		return nil
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(answer)), nil)
+	if err != nil {
+		return nil
+	}
+	resp.Body.Close()
+
+	info := &HTTPInfo{
+		Proto:      resp.Proto,
+		StatusCode: resp.StatusCode,
+		Status:     strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode))),
+		Headers:    resp.Header,
+	}
+	if _, body, ok := bytes.Cut(answer, []byte("\r\n\r\n")); ok {
+		if m := titlePattern.FindSubmatch(body); m != nil {
+			info.Title = strings.Join(strings.Fields(html.UnescapeString(string(m[1]))), " ")
+		}
+	}
+	return info
+}
+
+// milliseconds returns d in milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/clwg/netsecutils/pkg/ratelimit"
+)
+
+// Port states.
+const (
+	StateOpen     = "open"
+	StateClosed   = "closed"   // refused with a RST
+	StateFiltered = "filtered" // no answer, or an ICMP error, within the retries
+)
+
+// PortResult is the outcome of scanning one port.
+type PortResult struct {
+	Port     int
+	Protocol string // tcp or udp
+	State    string
+	RTT      time.Duration // round trip time of the answer, 0 when filtered
+	Attempts int
+	Service  string // name of the UDP probe sent
+	Response []byte // answer to the UDP probe
+}
+
+// PortScanner scans one port of a host.
+type PortScanner interface {
+	Scan(host string, port int) PortResult
+}
+
+// ConnectScanner scans ports by completing TCP connections.
+type ConnectScanner struct {
+	Limiter *ratelimit.Limiter
+	Hosts   *hostTable
+	Timing  Timing
+	Retries int // additional attempts after a timeout
+}
+
+// Scan connects to host:port, retrying timed out attempts with a doubled
+// timeout.
+func (s *ConnectScanner) Scan(host string, port int) PortResult {
+	h := s.Hosts.get(host)
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	result := PortResult{Port: port, Protocol: "tcp", State: StateFiltered}
+
+	for attempt := 0; attempt <= s.Retries; attempt++ {
+		s.Limiter.Wait()
+		h.acquire()
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", address, h.timeout(s.Timing, attempt))
+		rtt := time.Since(start)
+		h.release()
+		result.Attempts++
+
+		if err == nil {
+			conn.Close()
+			h.observe(rtt)
+			result.State, result.RTT = StateOpen, rtt
+			return result
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+			h.observe(rtt)
+			result.State, result.RTT = StateClosed, rtt
+			return result
+		}
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			// Unreachable hosts and networks are reported by ICMP and
+			// do not improve with retries.
+			return result
+		}
+	}
+	return result
+}
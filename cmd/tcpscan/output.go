@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	jsonllogger "github.com/clwg/netsecutils/pkg/logging"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ResultWriter writes the results of hosts as their scans complete.
+type ResultWriter interface {
+	Write(result HostResult) error
+	Close() error
+}
+
+// newResultWriter returns a writer of format to w. args is the command line
+// and total the number of targets, reported by the formats with a summary.
+func newResultWriter(format string, w io.Writer, args string, total uint64) (ResultWriter, error) {
+	start := time.Now()
+	switch format {
+	case "jsonl":
+		return &jsonlWriter{enc: json.NewEncoder(w)}, nil
+	case "json":
+		return &jsonWriter{w: w}, nil
+	case "csv":
+		cw := csv.NewWriter(w)
+		err := cw.Write([]string{"host", "protocol", "port", "state", "service", "product", "version", "extrainfo",
+			"confidence", "cpes", "tls_version", "tls_cipher", "banner"})
+		return &csvWriter{w: cw}, err
+	case "grepable":
+		_, err := fmt.Fprintf(w, "# tcpscan scan initiated %s as: %s\n", start.Format(time.ANSIC), args)
+		return &grepableWriter{w: w, start: start, total: total}, err
+	case "xml":
+		_, err := fmt.Fprintf(w, "%s<nmaprun scanner=\"tcpscan\" args=\"%s\" start=\"%d\" startstr=\"%s\" xmloutputversion=\"1.05\">\n",
+			xml.Header, xmlEscape(args), start.Unix(), start.Format(time.ANSIC))
+		return &xmlWriter{w: w, start: start, total: total}, err
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// portRow is a port of a host result, as the tabular formats list them.
+type portRow struct {
+	Protocol string
+	Port     int
+	State    string
+	Service  ServiceInfo
+	TLS      TLSInfo
+	Banner   string
+}
+
+// portRows returns the ports of result that are not filtered, TCP before
+// UDP, with the services identified or guessed from the port numbers.
+func portRows(result HostResult) []portRow {
+	var rows []portRow
+	add := func(protocol, state string, ports []int) {
+		for _, port := range ports {
+			rows = append(rows, portRow{Protocol: protocol, Port: port, State: state})
+		}
+	}
+	add("tcp", StateOpen, result.Ports)
+	add("tcp", StateClosed, result.Closed)
+	add("udp", StateOpen, result.UDPPorts)
+	add("udp", StateClosed, result.UDPClosed)
+	add("udp", StateOpenFiltered, result.UDPOpenFiltered)
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].Protocol != rows[j].Protocol {
+			return rows[i].Protocol == "tcp"
+		}
+		return rows[i].Port < rows[j].Port
+	})
+
+	for i := range rows {
+		row := &rows[i]
+		row.Service = guessService(row.Protocol, row.Port)
+		for _, info := range result.Services {
+			if info.Protocol == row.Protocol && info.Portid == strconv.Itoa(row.Port) {
+				row.Service = info
+			}
+		}
+		if row.Protocol == "tcp" {
+			for _, info := range result.TLS {
+				if info.Port == row.Port {
+					row.TLS = info
+				}
+			}
+		}
+		for _, banner := range result.Banner {
+			if banner.Protocol == row.Protocol && banner.Port == row.Port {
+				row.Banner = banner.Banner
+			}
+		}
+	}
+	return rows
+}
+
+// jsonlWriter writes a JSON object per host and line.
+type jsonlWriter struct {
+	enc *json.Encoder
+}
+
+func (w *jsonlWriter) Write(result HostResult) error { return w.enc.Encode(result) }
+func (w *jsonlWriter) Close() error                  { return nil }
+
+// jsonWriter writes one indented JSON array of the hosts once the scan
+// completes.
+type jsonWriter struct {
+	w       io.Writer
+	results []HostResult
+}
+
+func (w *jsonWriter) Write(result HostResult) error {
+	w.results = append(w.results, result)
+	return nil
+}
+
+func (w *jsonWriter) Close() error {
+	if w.results == nil {
+		w.results = []HostResult{}
+	}
+	jsonData, err := json.MarshalIndent(w.results, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w.w, string(jsonData))
+	return err
+}
+
+// csvWriter writes a row per port that is not filtered.
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (w *csvWriter) Write(result HostResult) error {
+	for _, row := range portRows(result) {
+		w.w.Write([]string{result.Host, row.Protocol, strconv.Itoa(row.Port), row.State,
+			row.Service.Service, row.Service.Product, row.Service.Version, row.Service.Extrainfo,
+			row.Service.Confidence, strings.Join(row.Service.CPEs, " "),
+			row.TLS.Version, row.TLS.Cipher, row.Banner})
+	}
+	w.w.Flush()
+	return w.w.Error()
+}
+
+func (w *csvWriter) Close() error { return nil }
+
+// grepableWriter writes hosts in the grepable format of nmap's -oG, a line
+// per host listing its ports.
+type grepableWriter struct {
+	w     io.Writer
+	start time.Time
+	total uint64
+	up    int
+}
+
+func (w *grepableWriter) Write(result HostResult) error {
+	w.up++
+	var ports []string
+	for _, row := range portRows(result) {
+		version := strings.Join(strings.Fields(strings.Join([]string{row.Service.Product, row.Service.Version, row.Service.Extrainfo}, " ")), " ")
+		ports = append(ports, fmt.Sprintf("%d/%s/%s//%s//%s/", row.Port, row.State, row.Protocol,
+			grepableField(row.Service.Service), grepableField(version)))
+	}
+	line := fmt.Sprintf("Host: %s ()\tPorts: %s", result.Host, strings.Join(ports, ", "))
+	if filtered := len(result.Filtered) + len(result.UDPFiltered); filtered > 0 {
+		line += fmt.Sprintf("\tIgnored State: filtered (%d)", filtered)
+	}
+	_, err := fmt.Fprintf(w.w, "Host: %s ()\tStatus: Up\n%s\n", result.Host, line)
+	return err
+}
+
+func (w *grepableWriter) Close() error {
+	end := time.Now()
+	_, err := fmt.Fprintf(w.w, "# tcpscan done at %s -- %d IP addresses (%d hosts up) scanned in %.2f seconds\n",
+		end.Format(time.ANSIC), w.total, w.up, end.Sub(w.start).Seconds())
+	return err
+}
+
+// grepableField replaces the separators of the grepable format in s.
+func grepableField(s string) string {
+	return strings.NewReplacer("/", "|", ",", ";", "\t", " ").Replace(s)
+}
+
+// xmlWriter writes hosts in nmap's XML format, which nmapxmltojson and other
+// nmap tooling read.
+type xmlWriter struct {
+	w     io.Writer
+	start time.Time
+	total uint64
+	up    int
+}
+
+// xmlHost is a host element of nmap's XML format.
+type xmlHost struct {
+	XMLName xml.Name `xml:"host"`
+	Status  struct {
+		State  string `xml:"state,attr"`
+		Reason string `xml:"reason,attr"`
+	} `xml:"status"`
+	Address struct {
+		Addr     string `xml:"addr,attr"`
+		AddrType string `xml:"addrtype,attr"`
+	} `xml:"address"`
+	Ports struct {
+		ExtraPorts *xmlExtraPorts `xml:"extraports"`
+		Port       []xmlPort      `xml:"port"`
+	} `xml:"ports"`
+	Times struct {
+		SRTT int64 `xml:"srtt,attr"`
+	} `xml:"times"`
+}
+
+// xmlExtraPorts counts the ports of a state left out of a host element.
+type xmlExtraPorts struct {
+	State string `xml:"state,attr"`
+	Count int    `xml:"count,attr"`
+}
+
+// xmlPort is a port element of nmap's XML format.
+type xmlPort struct {
+	Protocol string `xml:"protocol,attr"`
+	Portid   int    `xml:"portid,attr"`
+	State    struct {
+		State string `xml:"state,attr"`
+	} `xml:"state"`
+	Service struct {
+		Name       string   `xml:"name,attr"`
+		Product    string   `xml:"product,attr,omitempty"`
+		Version    string   `xml:"version,attr,omitempty"`
+		Extrainfo  string   `xml:"extrainfo,attr,omitempty"`
+		Ostype     string   `xml:"ostype,attr,omitempty"`
+		Tunnel     string   `xml:"tunnel,attr,omitempty"`
+		Method     string   `xml:"method,attr"`
+		Confidence string   `xml:"conf,attr"`
+		CPEs       []string `xml:"cpe"`
+	} `xml:"service"`
+	Script []xmlScript `xml:"script"`
+}
+
+// xmlScript is a script result element of nmap's XML format, used for the
+// banner.
+type xmlScript struct {
+	ID     string `xml:"id,attr"`
+	Output string `xml:"output,attr"`
+}
+
+func (w *xmlWriter) Write(result HostResult) error {
+	w.up++
+	var host xmlHost
+	host.Status.State, host.Status.Reason = "up", "user-set"
+	host.Address.Addr, host.Address.AddrType = result.Host, "ipv4"
+	if ip := net.ParseIP(result.Host); ip != nil && ip.To4() == nil {
+		host.Address.AddrType = "ipv6"
+	}
+	if filtered := len(result.Filtered) + len(result.UDPFiltered); filtered > 0 {
+		host.Ports.ExtraPorts = &xmlExtraPorts{State: StateFiltered, Count: filtered}
+	}
+	host.Times.SRTT = int64(result.RTTMs * 1000)
+
+	for _, row := range portRows(result) {
+		var port xmlPort
+		port.Protocol, port.Portid = row.Protocol, row.Port
+		port.State.State = row.State
+		s := &port.Service
+		s.Name, s.Product, s.Version = row.Service.Service, row.Service.Product, row.Service.Version
+		s.Extrainfo, s.Ostype, s.CPEs = row.Service.Extrainfo, row.Service.Ostype, row.Service.CPEs
+		s.Method, s.Confidence = "table", row.Service.Confidence
+		if s.Confidence == ConfidenceProbed {
+			s.Method = "probed"
+		}
+		if s.Confidence == "" {
+			s.Confidence = "0"
+		}
+		if row.TLS.Version != "" && row.TLS.StartTLS == "" {
+			s.Tunnel = "ssl"
+		}
+		if row.Banner != "" {
+			port.Script = append(port.Script, xmlScript{ID: "banner", Output: row.Banner})
+		}
+		host.Ports.Port = append(host.Ports.Port, port)
+	}
+
+	b, err := xml.MarshalIndent(host, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w.w, "%s\n", b)
+	return err
+}
+
+func (w *xmlWriter) Close() error {
+	end := time.Now()
+	_, err := fmt.Fprintf(w.w, "<runstats><finished time=\"%d\" timestr=\"%s\" elapsed=\"%.2f\"/>"+
+		"<hosts up=\"%d\" down=\"%d\" total=\"%d\"/></runstats>\n</nmaprun>\n",
+		end.Unix(), end.Format(time.ANSIC), end.Sub(w.start).Seconds(), w.up, w.total-uint64(w.up), w.total)
+	return err
+}
+
+// xmlEscape escapes s for an XML attribute.
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// logWriter logs each host result through jsonllogger.
+type logWriter struct {
+	logger *jsonllogger.Logger
+}
+
+func (w *logWriter) Write(result HostResult) error { return w.logger.Log(result) }
+func (w *logWriter) Close() error                  { return nil }
+
+const schema = `
+CREATE TABLE IF NOT EXISTS hosts (
+    timestamp TIMESTAMP,
+    host TEXT,
+    rtt_ms REAL,
+    result TEXT
+);
+CREATE TABLE IF NOT EXISTS ports (
+    timestamp TIMESTAMP,
+    host TEXT,
+    protocol TEXT,
+    port INTEGER,
+    state TEXT,
+    service TEXT,
+    product TEXT,
+    version TEXT,
+    extrainfo TEXT,
+    confidence TEXT,
+    cpes TEXT,
+    tls_version TEXT,
+    tls_cipher TEXT,
+    tls_findings TEXT,
+    banner TEXT
+);
+`
+
+// dbWriter stores host results in SQLite: the result of each host as JSON
+// in hosts and a row per port that is not filtered in ports.
+type dbWriter struct {
+	db *sqlx.DB
+}
+
+// newDBWriter opens the database at path, creating the tables.
+func newDBWriter(path string) (*dbWriter, error) {
+	db, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &dbWriter{db: db}, nil
+}
+
+func (w *dbWriter) Write(result HostResult) error {
+	now := time.Now()
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	tx, err := w.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("INSERT INTO hosts (timestamp, host, rtt_ms, result) VALUES (?, ?, ?, ?)",
+		now, result.Host, result.RTTMs, string(jsonData)); err != nil {
+		return err
+	}
+	for _, row := range portRows(result) {
+		_, err := tx.Exec(`INSERT INTO ports (timestamp, host, protocol, port, state, service, product, version, extrainfo,
+			confidence, cpes, tls_version, tls_cipher, tls_findings, banner)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			now, result.Host, row.Protocol, row.Port, row.State, row.Service.Service, row.Service.Product,
+			row.Service.Version, row.Service.Extrainfo, row.Service.Confidence, strings.Join(row.Service.CPEs, " "),
+			row.TLS.Version, row.TLS.Cipher, strings.Join(row.TLS.Findings, "; "), row.Banner)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (w *dbWriter) Close() error { return w.db.Close() }
+
+// multiWriter writes results to each of its writers.
+type multiWriter []ResultWriter
+
+func (m multiWriter) Write(result HostResult) error {
+	for _, w := range m {
+		if err := w.Write(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiWriter) Close() error {
+	var first error
+	for _, w := range m {
+		if err := w.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
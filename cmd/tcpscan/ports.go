@@ -0,0 +1,147 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// topPortsTable lists "<port>/<protocol>" lines ordered by how often the
+// ports are found open, most frequent first. It is an ordered list without
+// the frequencies, so presets select ports by count.
+//
+//go:embed top-ports.txt
+var topPortsTable string
+
+// PortList holds the ports to scan for each protocol.
+type PortList struct {
+	TCP []int
+	UDP []int
+}
+
+// parsePorts parses a comma-separated port specification of ports (22),
+// ranges (8000-8100, -1024, 60000-) and presets (top-100, all). Items are TCP
+// unless a T: or U: prefix switches the protocol of the items that follow,
+// as in T:22,80,U:53,161. Duplicate ports are dropped and the order is kept.
+func parsePorts(spec string) (*PortList, error) {
+	list := &PortList{}
+	seen := map[string]map[int]bool{"tcp": {}, "udp": {}}
+	proto := "tcp"
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		switch {
+		case strings.HasPrefix(strings.ToUpper(item), "T:"):
+			proto, item = "tcp", item[2:]
+		case strings.HasPrefix(strings.ToUpper(item), "U:"):
+			proto, item = "udp", item[2:]
+		}
+		if item == "" {
+			continue
+		}
+
+		ports, err := parsePortItem(proto, item)
+		if err != nil {
+			return nil, err
+		}
+		for _, port := range ports {
+			if seen[proto][port] {
+				continue
+			}
+			seen[proto][port] = true
+			if proto == "tcp" {
+				list.TCP = append(list.TCP, port)
+			} else {
+				list.UDP = append(list.UDP, port)
+			}
+		}
+	}
+
+	if len(list.TCP) == 0 && len(list.UDP) == 0 {
+		return nil, fmt.Errorf("no ports given")
+	}
+	return list, nil
+}
+
+// parsePortItem parses a single port, range or preset.
+func parsePortItem(proto, item string) ([]int, error) {
+	lower := strings.ToLower(item)
+	switch {
+	case lower == "all":
+		return portRange(1, 65535), nil
+	case strings.HasPrefix(lower, "top-"):
+		n, err := strconv.Atoi(lower[len("top-"):])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid preset %q, use top-<n>", item)
+		}
+		return topPorts(proto, n)
+	}
+
+	start, end, isRange := strings.Cut(item, "-")
+	if !isRange {
+		port, err := parsePort(item)
+		if err != nil {
+			return nil, err
+		}
+		return []int{port}, nil
+	}
+
+	first, last := 1, 65535
+	var err error
+	if start != "" {
+		if first, err = parsePort(start); err != nil {
+			return nil, err
+		}
+	}
+	if end != "" {
+		if last, err = parsePort(end); err != nil {
+			return nil, err
+		}
+	}
+	if first > last {
+		return nil, fmt.Errorf("invalid port range %q", item)
+	}
+	return portRange(first, last), nil
+}
+
+// parsePort parses a port number between 1 and 65535.
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q, ports are 1-65535", s)
+	}
+	return port, nil
+}
+
+// portRange returns the ports from first to last.
+func portRange(first, last int) []int {
+	ports := make([]int, 0, last-first+1)
+	for port := first; port <= last; port++ {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// topPorts returns the n most frequently open ports of proto, or an error when
+// the table lists fewer.
+func topPorts(proto string, n int) ([]int, error) {
+	var ports []int
+	for _, line := range strings.Split(topPortsTable, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		port, lineProto, ok := strings.Cut(strings.Fields(line)[0], "/")
+		if !ok || lineProto != proto {
+			continue
+		}
+		if p, err := strconv.Atoi(port); err == nil {
+			ports = append(ports, p)
+		}
+		if len(ports) == n {
+			return ports, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid preset top-%d: only %d %s ports are listed", n, len(ports), proto)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"regexp"
+	"time"
+)
+
+// serviceProbe is a payload sent to a port and the rules matching answers.
+type serviceProbe struct {
+	Name     string
+	Payload  []byte        // nil for the null probe, which only listens
+	Wait     time.Duration // time to wait for the first bytes of an answer
+	Ports    []int         // ports the probe is tried first on
+	PortOnly bool          // only sent to Ports, for probes with weak matches
+	Matches  []serviceMatch
+}
+
+// serviceMatch identifies a service from an answer. The templates may
+// reference submatches of the pattern as $1 or ${1}. Patterns are matched
+// against the answer with each byte as one character, so \xff matches the
+// byte 0xff, and . matches newlines.
+type serviceMatch struct {
+	Service string
+	Pattern *regexp.Regexp
+	Product string
+	Version string
+	Info    string
+	OS      string
+	CPE     string
+}
+
+// match returns a rule for pattern.
+func match(service, pattern string, fields ...string) serviceMatch {
+	m := serviceMatch{Service: service, Pattern: regexp.MustCompile("(?s)" + pattern)}
+	for i, field := range fields {
+		switch i {
+		case 0:
+			m.Product = field
+		case 1:
+			m.Version = field
+		case 2:
+			m.Info = field
+		case 3:
+			m.OS = field
+		case 4:
+			m.CPE = field
+		}
+	}
+	return m
+}
+
+// serviceProbes are tried in order, after ordering those hinting the port
+// first; the null probe always goes first.
+var serviceProbes = []serviceProbe{
+	{
+		Name: "null",
+		Wait: 2 * time.Second,
+		Matches: []serviceMatch{
+			match("ssh", `^SSH-([\d.]+)-OpenSSH_([\w.]+)[ -]?([^\r\n]*)\r?\n`, "OpenSSH", "$2", "protocol $1 $3", "", "cpe:/a:openbsd:openssh:$2"),
+			match("ssh", `^SSH-([\d.]+)-dropbear_([\w.]+)\r?\n`, "Dropbear sshd", "$2", "protocol $1", "Linux", "cpe:/a:matt_johnston:dropbear_ssh_server:$2"),
+			match("ssh", `^SSH-([\d.]+)-([^\r\n]*)\r?\n`, "", "", "protocol $1 $2"),
+			match("ftp", `^220[ -].*vsFTPd ([\w.]+)`, "vsftpd", "$1", "", "Unix", "cpe:/a:beasts:vsftpd:$1"),
+			match("ftp", `^220[ -].*ProFTPD ([\w.]+)`, "ProFTPD", "$1", "", "Unix", "cpe:/a:proftpd:proftpd:$1"),
+			match("ftp", `^220[ -].*FileZilla Server(?: version)? ([\w.]+)`, "FileZilla ftpd", "$1", "", "Windows", "cpe:/a:filezilla-project:filezilla_server:$1"),
+			match("ftp", `^220[ -][^\r\n]*FTP`),
+			match("smtp", `^220 ([\w.-]+) ESMTP Postfix`, "Postfix smtpd", "", "host $1", "", "cpe:/a:postfix:postfix"),
+			match("smtp", `^220 ([\w.-]+) ESMTP Exim ([\d.]+)`, "Exim smtpd", "$2", "host $1", "", "cpe:/a:exim:exim:$2"),
+			match("smtp", `^220 ([\w.-]+) Microsoft ESMTP MAIL Service`, "Microsoft Exchange smtpd", "", "host $1", "Windows", "cpe:/a:microsoft:exchange_server"),
+			match("smtp", `^220[ -][^\r\n]*E?SMTP`),
+			match("pop3", `^\+OK[^\r\n]*Dovecot`, "Dovecot pop3d", "", "", "", "cpe:/a:dovecot:dovecot"),
+			match("pop3", `^\+OK`),
+			match("imap", `^\* OK[^\r\n]*Dovecot`, "Dovecot imapd", "", "", "", "cpe:/a:dovecot:dovecot"),
+			match("imap", `^\* OK[^\r\n]*IMAP`),
+			match("mysql", `^.\x00\x00\x00\x0a(\d[\w.]*-MariaDB[\w.-]*)\x00`, "MariaDB", "$1", "", "", "cpe:/a:mariadb:mariadb:$1"),
+			match("mysql", `^.\x00\x00\x00\x0a(\d[\w.-]*)\x00`, "MySQL", "$1", "", "", "cpe:/a:mysql:mysql:$1"),
+			match("mysql", `^.\x00\x00\x00\xffj\x04Host '[^']*' is not allowed`, "MySQL", "", "unauthorized"),
+			match("vnc", `^RFB (\d+)\.(\d+)\n`, "VNC", "", "protocol $1.$2"),
+			match("telnet", `^\xff[\xfb-\xfe]`),
+		},
+	},
+	{
+		Name:    "http",
+		Payload: []byte("GET / HTTP/1.0\r\n\r\n"),
+		Wait:    5 * time.Second,
+		Ports:   []int{80, 81, 591, 2000, 3000, 5000, 7070, 8000, 8008, 8080, 8081, 8088, 8888, 9000, 9090},
+		Matches: []serviceMatch{
+			match("http", `^HTTP/1\.[01] \d\d\d.*?\r\nServer: Apache/([\d.]+)(?: \(([^)\r\n]+)\))?`, "Apache httpd", "$1", "$2", "", "cpe:/a:apache:http_server:$1"),
+			match("http", `^HTTP/1\.[01] \d\d\d.*?\r\nServer: nginx/([\d.]+)`, "nginx", "$1", "", "", "cpe:/a:f5:nginx:$1"),
+			match("http", `^HTTP/1\.[01] \d\d\d.*?\r\nServer: Microsoft-IIS/([\d.]+)`, "Microsoft IIS httpd", "$1", "", "Windows", "cpe:/a:microsoft:internet_information_services:$1"),
+			match("http", `^HTTP/1\.[01] \d\d\d.*?\r\nServer: lighttpd/([\d.]+)`, "lighttpd", "$1", "", "", "cpe:/a:lighttpd:lighttpd:$1"),
+			match("http", `^HTTP/1\.[01] \d\d\d.*?\r\nServer: SimpleHTTP/([\d.]+) Python/([\w.]+)`, "SimpleHTTPServer", "$1", "Python $2", "", "cpe:/a:python:python:$2"),
+			match("http", `^HTTP/1\.[01] \d\d\d.*?\r\nServer: ([^\r\n]+)`, "$1"),
+			match("http", `^HTTP/1\.[01] \d\d\d`),
+		},
+	},
+	{
+		Name:    "tls",
+		Payload: clientHello(tls.VersionTLS12, helloSuites, nil, ""),
+		Wait:    5 * time.Second,
+		Ports:   tlsPorts,
+		Matches: []serviceMatch{
+			match("ssl", `^\x16\x03[\x00-\x04]..\x02`),
+			match("ssl", `^\x15\x03[\x00-\x04]\x00\x02\x02`, "", "", "handshake failure"),
+		},
+	},
+	{
+		Name:    "smb",
+		Payload: smbNegotiate(),
+		Wait:    5 * time.Second,
+		Ports:   []int{139, 445},
+		Matches: []serviceMatch{
+			match("microsoft-ds", `^\x00...\xffSMBr`, "SMB", "", "SMBv1 dialect"),
+			match("microsoft-ds", `^\x00...\xfeSMB`, "SMB", "", "SMBv2+ dialect"),
+		},
+	},
+	{
+		Name:    "rdp",
+		Payload: []byte("\x03\x00\x00\x13\x0e\xe0\x00\x00\x00\x00\x00\x01\x00\x08\x00\x03\x00\x00\x00"),
+		Wait:    5 * time.Second,
+		Ports:   []int{3389},
+		Matches: []serviceMatch{
+			match("ms-wbt-server", `^\x03\x00\x00\x13\x0e\xd0.{5}\x02`, "Microsoft Terminal Services", "", "", "Windows", "cpe:/o:microsoft:windows"),
+			match("ms-wbt-server", `^\x03\x00\x00[\x0b\x13]\x0e\xd0`),
+		},
+	},
+	{
+		Name:    "redis",
+		Payload: []byte("*1\r\n$4\r\nINFO\r\n"),
+		Wait:    3 * time.Second,
+		Ports:   []int{6379},
+		Matches: []serviceMatch{
+			match("redis", `^\$\d+\r\n.*?redis_version:([\d.]+)`, "Redis key-value store", "$1", "", "", "cpe:/a:redislabs:redis:$1"),
+			match("redis", `^-NOAUTH `, "Redis key-value store", "", "authentication required"),
+			match("redis", `^-DENIED Redis`, "Redis key-value store", "", "protected mode"),
+		},
+	},
+	{
+		Name:    "memcached",
+		Payload: []byte("version\r\n"),
+		Wait:    3 * time.Second,
+		Ports:   []int{11211},
+		Matches: []serviceMatch{
+			match("memcached", `^VERSION ([\d.]+)\r\n`, "Memcached", "$1", "", "", "cpe:/a:memcached:memcached:$1"),
+		},
+	},
+	{
+		Name:     "postgresql",
+		Payload:  []byte("\x00\x00\x00\x08\x04\xd2\x16\x2f"), // SSLRequest
+		Wait:     3 * time.Second,
+		Ports:    []int{5432},
+		PortOnly: true,
+		Matches: []serviceMatch{
+			match("postgresql", `^[SN]$`, "PostgreSQL DB", "", "", "", "cpe:/a:postgresql:postgresql"),
+		},
+	},
+}
+
+// portServices names the services usually found on ports, reported with a
+// low confidence when no probe matched.
+var portServices = map[int]string{
+	21: "ftp", 22: "ssh", 23: "telnet", 25: "smtp", 53: "domain", 80: "http", 110: "pop3",
+	111: "rpcbind", 135: "msrpc", 139: "netbios-ssn", 143: "imap", 389: "ldap", 443: "https",
+	445: "microsoft-ds", 465: "smtps", 587: "submission", 636: "ldapssl", 993: "imaps",
+	995: "pop3s", 1433: "ms-sql-s", 1521: "oracle", 2049: "nfs", 3306: "mysql",
+	3389: "ms-wbt-server", 5432: "postgresql", 5900: "vnc", 6379: "redis", 8000: "http-alt",
+	8080: "http-proxy", 8443: "https-alt", 9200: "wap-wsp", 11211: "memcache", 27017: "mongod",
+}
+
+// smbNegotiate returns an SMBv1 negotiate request offering the dialects from
+// PC NETWORK PROGRAM 1.0 to NT LM 0.12, framed for NetBIOS session service.
+func smbNegotiate() []byte {
+	dialects := []string{"PC NETWORK PROGRAM 1.0", "MICROSOFT NETWORKS 1.03", "MICROSOFT NETWORKS 3.0",
+		"LANMAN1.0", "LM1.2X002", "Samba", "NT LANMAN 1.0", "NT LM 0.12"}
+	var data []byte
+	for _, dialect := range dialects {
+		data = append(data, 0x02)
+		data = append(data, dialect...)
+		data = append(data, 0x00)
+	}
+
+	msg := []byte{
+		0xff, 'S', 'M', 'B', 0x72, // negotiate
+		0x00, 0x00, 0x00, 0x00, // status
+		0x08, 0x01, 0x40, // flags
+		0x00, 0x00, // PID high
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // signature
+		0x00, 0x00, // reserved
+		0x00, 0x00, // TID
+		0x40, 0x06, // PID
+		0x00, 0x00, // UID
+		0x01, 0x00, // MID
+		0x00, // word count
+	}
+	msg = binary.LittleEndian.AppendUint16(msg, uint16(len(data)))
+	msg = append(msg, data...)
+
+	frame := []byte{0x00, byte(len(msg) >> 16), byte(len(msg) >> 8), byte(len(msg))}
+	return append(frame, msg...)
+}
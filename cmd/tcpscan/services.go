@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/clwg/netsecutils/pkg/ratelimit"
+)
+
+// Confidence of a service identification, on nmap's scale of 0 to 10.
+const (
+	ConfidenceProbed = "10" // an answer matched a probe rule
+	ConfidencePort   = "3"  // guessed from the port number
+)
+
+const (
+	maxAnswer    = 16384                  // bytes of an answer read for matching
+	answerLinger = 250 * time.Millisecond // wait for more bytes after each read
+)
+
+// ServiceInfo identifies the service on a port. It has the fields and JSON
+// names of nmapxmltojson's PortInfo so both outputs are processed alike.
+type ServiceInfo struct {
+	Protocol   string   `json:"protocol"`
+	Portid     string   `json:"portid"`
+	Service    string   `json:"service"`
+	Product    string   `json:"product"`
+	Version    string   `json:"version"`
+	Extrainfo  string   `json:"extrainfo"`
+	Ostype     string   `json:"ostype"`
+	Confidence string   `json:"confidence"`
+	CPEs       []string `json:"cpes"`
+}
+
+// String returns the service name followed by the product, version and extra
+// information known.
+func (s ServiceInfo) String() string {
+	return strings.Join(strings.Fields(strings.Join([]string{s.Service, s.Product, s.Version, s.Extrainfo}, " ")), " ")
+}
+
+// ServiceDetector identifies TCP services by sending the probes of
+// serviceProbes, each over a new connection, until an answer matches.
+type ServiceDetector struct {
+	Limiter *ratelimit.Limiter
+	Timeout time.Duration // connection timeout
+	Wait    time.Duration // overrides the probes' answer waits when set
+}
+
+// Detect identifies the service on the open TCP port host:port. Without a
+// matching answer the service is guessed from the port.
+func (d *ServiceDetector) Detect(host string, port int) ServiceInfo {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	for _, p := range probesFor(port) {
+		answer, err := d.probe(address, p)
+		if err != nil {
+			if p.Payload == nil {
+				// The port no longer accepts connections.
+				break
+			}
+			continue
+		}
+		if info, ok := matchAnswer(p, answer); ok {
+			info.Protocol, info.Portid = "tcp", strconv.Itoa(port)
+			return info
+		}
+	}
+	return guessService("tcp", port)
+}
+
+// probe sends p to address and returns the answer.
+func (d *ServiceDetector) probe(address string, p serviceProbe) ([]byte, error) {
+	d.Limiter.Wait()
+	conn, err := net.DialTimeout("tcp", address, d.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	wait := p.Wait
+	if d.Wait > 0 {
+		wait = d.Wait
+	}
+	if p.Payload != nil {
+		conn.SetWriteDeadline(time.Now().Add(wait))
+		if _, err := conn.Write(p.Payload); err != nil {
+			return nil, err
+		}
+	}
+	answer, _ := readAnswer(conn, wait, maxAnswer)
+	return answer, nil
+}
+
+// readAnswer reads from conn until it is closed, limit bytes arrived or no
+// bytes arrive for wait at first and for answerLinger after that. It also
+// returns when the first bytes arrived.
+func readAnswer(conn net.Conn, wait time.Duration, limit int) ([]byte, time.Time) {
+	buf := make([]byte, limit)
+	n := 0
+	var first time.Time
+	conn.SetReadDeadline(time.Now().Add(wait))
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		if m > 0 && n == 0 {
+			first = time.Now()
+		}
+		n += m
+		if err != nil {
+			break
+		}
+		conn.SetReadDeadline(time.Now().Add(answerLinger))
+	}
+	return buf[:n], first
+}
+
+// probesFor returns the probes to send to port: the null probe, those hinting
+// the port, then the others that are not restricted to their ports.
+func probesFor(port int) []serviceProbe {
+	var hinted, rest []serviceProbe
+	for _, p := range serviceProbes {
+		switch {
+		case p.Payload == nil || hasPort(p.Ports, port):
+			hinted = append(hinted, p)
+		case !p.PortOnly:
+			rest = append(rest, p)
+		}
+	}
+	return append(hinted, rest...)
+}
+
+// matchAnswer returns the service identified by the first rule of p matching
+// answer.
+func matchAnswer(p serviceProbe, answer []byte) (ServiceInfo, bool) {
+	if len(answer) == 0 {
+		return ServiceInfo{}, false
+	}
+	// One character per byte, so patterns match binary answers bytewise.
+	runes := make([]rune, len(answer))
+	for i, b := range answer {
+		runes[i] = rune(b)
+	}
+	s := string(runes)
+
+	for _, m := range p.Matches {
+		idx := m.Pattern.FindStringSubmatchIndex(s)
+		if idx == nil {
+			continue
+		}
+		expand := func(template string) string {
+			return strings.Join(strings.Fields(string(m.Pattern.ExpandString(nil, template, s, idx))), " ")
+		}
+		info := ServiceInfo{
+			Service:    m.Service,
+			Product:    expand(m.Product),
+			Version:    expand(m.Version),
+			Extrainfo:  expand(m.Info),
+			Ostype:     expand(m.OS),
+			Confidence: ConfidenceProbed,
+			CPEs:       []string{},
+		}
+		if m.CPE != "" {
+			info.CPEs = append(info.CPEs, strings.TrimRight(expand(m.CPE), ":"))
+		}
+		return info, true
+	}
+	return ServiceInfo{}, false
+}
+
+// udpService identifies the service of an open UDP port from the probe it
+// answered.
+func udpService(result PortResult) ServiceInfo {
+	if result.Service == "" {
+		return guessService("udp", result.Port)
+	}
+	return ServiceInfo{
+		Protocol:   "udp",
+		Portid:     strconv.Itoa(result.Port),
+		Service:    result.Service,
+		Confidence: ConfidenceProbed,
+		CPEs:       []string{},
+	}
+}
+
+// guessService names the service usually found on port.
+func guessService(protocol string, port int) ServiceInfo {
+	info := ServiceInfo{
+		Protocol: protocol,
+		Portid:   strconv.Itoa(port),
+		Service:  "unknown",
+		CPEs:     []string{},
+	}
+	if name, ok := portServices[port]; ok {
+		info.Service, info.Confidence = name, ConfidencePort
+	}
+	return info
+}
+
+// hasPort reports whether ports contains port.
+func hasPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/clwg/netsecutils/pkg/ratelimit"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// synReply is a SYN/ACK or RST answering a probe.
+type synReply struct {
+	open bool // SYN/ACK rather than RST
+	ack  uint32
+	at   time.Time
+}
+
+// SynScanner scans ports with half-open connections. It sends SYNs from a
+// raw socket, recognizes answers by a keyed cookie in the sequence number and
+// resets open ports instead of completing the handshake. Hosts of a family
+// without a raw socket are scanned by Connect.
+type SynScanner struct {
+	Limiter *ratelimit.Limiter
+	Hosts   *hostTable
+	Timing  Timing
+	Retries int
+	Connect *ConnectScanner
+
+	conn4, conn6 net.PacketConn
+	srcPort      uint16
+	secret       []byte
+
+	mu      sync.Mutex
+	sources map[string]net.IP // local address used to reach each host
+	// waiting hands answers to the Scan call blocked on each host:port. The
+	// cookie authenticates answers, but Scan returns the state, round trip
+	// time and retries of a single port, so the answer has to reach it.
+	waiting map[string]chan synReply
+}
+
+// newSynScanner opens the raw sockets, which requires CAP_NET_RAW.
+func newSynScanner(connect *ConnectScanner) (*SynScanner, error) {
+	s := &SynScanner{
+		Limiter: connect.Limiter,
+		Hosts:   connect.Hosts,
+		Timing:  connect.Timing,
+		Retries: connect.Retries,
+		Connect: connect,
+		secret:  make([]byte, 16),
+		sources: make(map[string]net.IP),
+		waiting: make(map[string]chan synReply),
+	}
+	if _, err := rand.Read(s.secret); err != nil {
+		return nil, err
+	}
+	port, err := rand.Int(rand.Reader, big.NewInt(65535-32768))
+	if err != nil {
+		return nil, err
+	}
+	s.srcPort = uint16(32768 + port.Int64())
+
+	s.conn4, err = net.ListenPacket("ip4:tcp", "0.0.0.0")
+	if err != nil {
+		return nil, err
+	}
+	go s.receive(s.conn4)
+	// IPv6 may be unavailable; its hosts are then connect scanned.
+	if s.conn6, err = net.ListenPacket("ip6:tcp", "::"); err == nil {
+		go s.receive(s.conn6)
+	}
+	return s, nil
+}
+
+// Close closes the raw sockets.
+func (s *SynScanner) Close() {
+	s.conn4.Close()
+	if s.conn6 != nil {
+		s.conn6.Close()
+	}
+}
+
+// Scan sends SYNs to host:port until it answers or the retries run out.
+func (s *SynScanner) Scan(host string, port int) PortResult {
+	dst := net.ParseIP(host)
+	conn := s.conn4
+	if dst.To4() == nil {
+		conn = s.conn6
+	}
+	src, err := s.source(dst)
+	if conn == nil || err != nil {
+		return s.Connect.Scan(host, port)
+	}
+
+	h := s.Hosts.get(host)
+	key := waitKey(dst, uint16(port))
+	replies := make(chan synReply, 1)
+	s.mu.Lock()
+	s.waiting[key] = replies
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.waiting, key)
+		s.mu.Unlock()
+	}()
+
+	result := PortResult{Port: port, Protocol: "tcp", State: StateFiltered}
+	seq := s.cookie(src, dst, uint16(port))
+	for attempt := 0; attempt <= s.Retries; attempt++ {
+		s.Limiter.Wait()
+		h.acquire()
+		start := time.Now()
+		err := s.send(conn, src, dst, uint16(port), &layers.TCP{Seq: seq, SYN: true, Window: 1024})
+		result.Attempts++
+		if err != nil {
+			h.release()
+			return result
+		}
+
+		timer := time.NewTimer(h.timeout(s.Timing, attempt))
+		select {
+		case reply := <-replies:
+			timer.Stop()
+			h.release()
+			rtt := reply.at.Sub(start)
+			h.observe(rtt)
+			result.RTT = rtt
+			if reply.open {
+				result.State = StateOpen
+				s.send(conn, src, dst, uint16(port), &layers.TCP{Seq: reply.ack, RST: true})
+			} else {
+				result.State = StateClosed
+			}
+			return result
+		case <-timer.C:
+			h.release()
+		}
+	}
+	return result
+}
+
+// receive reads TCP segments from a raw socket and hands answers carrying a
+// valid cookie to the waiting probe.
+func (s *SynScanner) receive(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		at := time.Now()
+
+		var tcp layers.TCP
+		if err := tcp.DecodeFromBytes(buf[:n], gopacket.NilDecodeFeedback); err != nil {
+			continue
+		}
+		if uint16(tcp.DstPort) != s.srcPort || !tcp.ACK || !(tcp.SYN || tcp.RST) {
+			continue
+		}
+		srcIP := addr.(*net.IPAddr).IP
+		s.mu.Lock()
+		replies, ok := s.waiting[waitKey(srcIP, uint16(tcp.SrcPort))]
+		local := s.sources[srcIP.String()]
+		s.mu.Unlock()
+		if !ok || local == nil || tcp.Ack-1 != s.cookie(local, srcIP, uint16(tcp.SrcPort)) {
+			continue
+		}
+		select {
+		case replies <- synReply{open: tcp.SYN, ack: tcp.Ack, at: at}:
+		default:
+		}
+	}
+}
+
+// send writes a TCP segment from the scanner's source port to dst.
+func (s *SynScanner) send(conn net.PacketConn, src, dst net.IP, port uint16, tcp *layers.TCP) error {
+	tcp.SrcPort = layers.TCPPort(s.srcPort)
+	tcp.DstPort = layers.TCPPort(port)
+	if tcp.SYN {
+		tcp.Options = []layers.TCPOption{{
+			OptionType:   layers.TCPOptionKindMSS,
+			OptionLength: 4,
+			OptionData:   []byte{0x05, 0xb4}, // 1460
+		}}
+	}
+
+	var network gopacket.NetworkLayer
+	if dst.To4() != nil {
+		network = &layers.IPv4{SrcIP: src.To4(), DstIP: dst.To4(), Protocol: layers.IPProtocolTCP}
+	} else {
+		network = &layers.IPv6{SrcIP: src, DstIP: dst, NextHeader: layers.IPProtocolTCP}
+	}
+	if err := tcp.SetNetworkLayerForChecksum(network); err != nil {
+		return err
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+	if err := tcp.SerializeTo(buf, opts); err != nil {
+		return err
+	}
+	_, err := conn.WriteTo(buf.Bytes(), &net.IPAddr{IP: dst})
+	return err
+}
+
+// cookie returns the sequence number of probes to dst:port, a keyed hash of
+// the addresses and ports, so that answers are verified without storing
+// sequence numbers and stray or spoofed segments are dropped.
+func (s *SynScanner) cookie(src, dst net.IP, port uint16) uint32 {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(src.To16())
+	mac.Write(dst.To16())
+	binary.Write(mac, binary.BigEndian, [2]uint16{s.srcPort, port})
+	return binary.BigEndian.Uint32(mac.Sum(nil))
+}
+
+// source returns the local address the kernel routes dst from.
+func (s *SynScanner) source(dst net.IP) (net.IP, error) {
+	s.mu.Lock()
+	src, ok := s.sources[dst.String()]
+	s.mu.Unlock()
+	if ok {
+		return src, nil
+	}
+
+	// Connecting a UDP socket selects the route without sending anything.
+	conn, err := net.Dial("udp", net.JoinHostPort(dst.String(), "9"))
+	if err != nil {
+		return nil, fmt.Errorf("no route to %s: %w", dst, err)
+	}
+	src = conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+
+	s.mu.Lock()
+	s.sources[dst.String()] = src
+	s.mu.Unlock()
+	return src, nil
+}
+
+// waitKey identifies the probe waiting for answers from ip:port.
+func waitKey(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
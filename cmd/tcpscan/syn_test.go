@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSynScanLoopback(t *testing.T) {
+	s, err := newSynScanner(&ConnectScanner{
+		Hosts:   newHostTable(0),
+		Timing:  Timing{Initial: time.Second, Min: 100 * time.Millisecond, Max: time.Second},
+		Retries: 1,
+	})
+	if err != nil {
+		t.Skipf("raw sockets unavailable: %v", err)
+	}
+	defer s.Close()
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	open := listener.Addr().(*net.TCPAddr).Port
+
+	closedListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := closedListener.Addr().(*net.TCPAddr).Port
+	closedListener.Close()
+
+	for _, tt := range []struct {
+		port  int
+		state string
+	}{
+		{open, StateOpen},
+		{closed, StateClosed},
+	} {
+		result := s.Scan("127.0.0.1", tt.port)
+		if result.State != tt.state {
+			t.Errorf("port %d: state = %s, want %s", tt.port, result.State, tt.state)
+		}
+		if result.RTT <= 0 || result.Attempts != 1 {
+			t.Errorf("port %d: rtt = %v, attempts = %d, want an answer to the first SYN", tt.port, result.RTT, result.Attempts)
+		}
+	}
+
+	// The open port was reset rather than connected to.
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(200 * time.Millisecond))
+	if conn, err := listener.Accept(); err == nil {
+		conn.Close()
+		t.Error("SYN scan completed a connection")
+	}
+}
@@ -1,252 +1,438 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"net"
-	"strconv"
+	"os"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	jsonllogger "github.com/clwg/netsecutils/pkg/logging"
+	"github.com/clwg/netsecutils/pkg/ratelimit"
+	"github.com/clwg/netsecutils/pkg/target"
 )
 
 type HostResult struct {
-	Host   string       `json:"host"`
-	Ports  []int        `json:"ports"`
-	Banner []BannerInfo `json:"banner"`
+	Host            string        `json:"host"`
+	Ports           []int         `json:"ports"`
+	Closed          []int         `json:"closed,omitempty"`
+	Filtered        []int         `json:"filtered,omitempty"`
+	UDPPorts        []int         `json:"udp_ports,omitempty"`
+	UDPClosed       []int         `json:"udp_closed,omitempty"`
+	UDPOpenFiltered []int         `json:"udp_open_filtered,omitempty"`
+	UDPFiltered     []int         `json:"udp_filtered,omitempty"`
+	RTTMs           float64       `json:"rtt_ms,omitempty"`
+	Services        []ServiceInfo `json:"services,omitempty"`
+	TLS             []TLSInfo     `json:"tls,omitempty"`
+	Banner          []BannerInfo  `json:"banner"`
 }
 
 type BannerInfo struct {
-	Port   int    `json:"port"`
-	Banner string `json:"banner"`
+	Port        int       `json:"port"`
+	Protocol    string    `json:"protocol,omitempty"`
+	Service     string    `json:"service,omitempty"`
+	Banner      string    `json:"banner"`
+	Probe       string    `json:"probe,omitempty"`
+	TLS         bool      `json:"tls,omitempty"`
+	Raw         string    `json:"raw,omitempty"`
+	RawEncoding string    `json:"raw_encoding,omitempty"`
+	HTTP        *HTTPInfo `json:"http,omitempty"`
+	ConnectMs   float64   `json:"connect_ms,omitempty"`
+	TLSMs       float64   `json:"tls_ms,omitempty"`
+	FirstByteMs float64   `json:"first_byte_ms,omitempty"`
+	TotalMs     float64   `json:"total_ms,omitempty"`
 }
 
 func main() {
-	var ipRange, portRange string
-	flag.StringVar(&ipRange, "iprange", "", "IP range to scan (e.g., 192.168.0.1 or 192.168.0.1-192.168.1.24)")
-	flag.StringVar(&portRange, "ports", "", "Port range to scan (e.g., 80-100)")
+	var targetList, ipRange, exclude, portRange, scanType, bannerEncoding, format, output, dbfile string
+	var random, services, probeTLS, logResults bool
+	var seed int64
+	var concurrency, rate, hostParallelism, hostGroup, retries int
+	var timeout, minTimeout, maxTimeout, serviceWait, bannerBytes, bannerWait, progress int
+	flag.StringVar(&targetList, "targets", "", "Targets to scan: networks, ranges, addresses, hostnames or @files, comma-separated (e.g., 192.168.0.0/24,10.0.0.1-50)")
+	flag.StringVar(&ipRange, "iprange", "", "IP range to scan (e.g., 192.168.0.1 or 192.168.0.1-192.168.1.24), same as -targets")
+	flag.StringVar(&exclude, "exclude", "", "Targets to skip, in the same syntax as -targets")
+	flag.StringVar(&portRange, "ports", "top-1000", "Ports to scan: ports, ranges and top-<n> or all presets, with T: and U: protocol prefixes (e.g., 22,80,443,8000-8100)")
+	flag.StringVar(&scanType, "scan", "connect", "Scan type: connect, or syn for half-open scans with raw sockets (requires CAP_NET_RAW)")
+	flag.BoolVar(&random, "random", false, "Scan hosts in a random order")
+	flag.Int64Var(&seed, "seed", 0, "Seed of the random host order (default: time based)")
+	flag.IntVar(&concurrency, "concurrency", 1000, "Maximum connection attempts in flight")
+	flag.IntVar(&rate, "rate", 0, "Maximum connection attempts per second (0 for unlimited)")
+	flag.IntVar(&hostParallelism, "host-parallelism", 0, "Maximum connection attempts in flight per host (0 for unlimited)")
+	flag.IntVar(&hostGroup, "host-group", 64, "Number of hosts whose ports are scanned interleaved")
+	flag.IntVar(&retries, "retries", 1, "Number of retries after a timeout")
+	flag.IntVar(&timeout, "timeout", 1000, "Connection timeout in milliseconds until a host's round trip time is measured")
+	flag.IntVar(&minTimeout, "min-timeout", 100, "Minimum connection timeout in milliseconds")
+	flag.IntVar(&maxTimeout, "max-timeout", 5000, "Maximum connection timeout in milliseconds")
+	flag.BoolVar(&services, "services", false, "Identify the services on open ports with probes")
+	flag.IntVar(&serviceWait, "service-wait", 0, "Time in milliseconds to wait for answers to service probes (0 for the probes' defaults)")
+	flag.BoolVar(&probeTLS, "tls", false, "Collect the TLS versions, cipher suites, certificates and weaknesses of TLS and STARTTLS ports")
+	flag.IntVar(&bannerBytes, "banner-bytes", 4096, "Maximum bytes of each banner captured")
+	flag.StringVar(&bannerEncoding, "banner-encoding", "base64", "Encoding of the captured banner bytes: base64 or hex")
+	flag.IntVar(&bannerWait, "banner-wait", 2000, "Time in milliseconds to wait for a greeting before sending an HTTP request")
+	flag.StringVar(&format, "format", "jsonl", "Output format: jsonl, json, csv, grepable or xml (nmap's, for nmapxmltojson)")
+	flag.StringVar(&output, "output", "", "File to write the results to (default: standard output)")
+	flag.BoolVar(&logResults, "log", false, "Also log the results of hosts as JSON lines to ./logs")
+	flag.StringVar(&dbfile, "db", "", "SQLite database file to also store the results in")
+	flag.IntVar(&progress, "progress", 10, "Seconds between progress reports on standard error (0 to disable)")
 	flag.Parse()
 
-	ips := strings.Split(ipRange, "-")
-
-	var startIP, endIP net.IP
-
-	// Handle single IP or range of IPs
-	switch len(ips) {
-	case 1:
-		startIP = net.ParseIP(ips[0])
-		if startIP == nil {
-			fmt.Println("Invalid IP address format")
-			return
-		}
-		// Set endIP to be the same as startIP for single IP
-		endIP = startIP
-	case 2:
-		startIP = net.ParseIP(ips[0])
-		endIP = net.ParseIP(ips[1])
-		if startIP == nil || endIP == nil {
-			fmt.Println("Invalid IP address format")
-			return
-		}
-	default:
-		fmt.Println("Invalid IP range format. Use format like 192.168.0.1 or 192.168.0.1-192.168.1.24")
+	targets, err := target.Parse([]string{targetList, ipRange}, []string{exclude})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid targets: %v\n", err)
 		return
 	}
-
-	ports := strings.Split(portRange, "-")
-	if len(ports) != 2 {
-		fmt.Println("Invalid port range format. Use format like 80-100")
+	if targets.Len() == 0 {
+		fmt.Fprintln(os.Stderr, "No targets given, use -targets or -iprange")
 		return
 	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
 
-	startPort, endPort, err := parsePortRange(ports[0], ports[1])
+	ports, err := parsePorts(portRange)
 	if err != nil {
-		fmt.Printf("Invalid port range: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Invalid ports: %v\n", err)
 		return
 	}
 
-	// Perform scanning using goroutines
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, 1000) // Limit concurrent goroutines
-	openPorts := make(map[string][]int)    // Map to store open ports for each host
-	var openPortsMutex sync.Mutex          // Mutex to protect the map
-
-	lastIP := false
-
-	for ip := startIP; ; incrementIP(ip) {
-		fmt.Printf("scanning: %s\n", ip.String())
-		if ip.Equal(endIP) {
-			lastIP = true
-		}
+	if concurrency < 1 || hostGroup < 1 || bannerBytes < 1 {
+		fmt.Fprintln(os.Stderr, "-concurrency, -host-group and -banner-bytes must be at least 1")
+		return
+	}
+	if bannerEncoding != "base64" && bannerEncoding != "hex" {
+		fmt.Fprintf(os.Stderr, "Unknown banner encoding %q\n", bannerEncoding)
+		return
+	}
 
-		for port := startPort; port <= endPort; port++ {
-			wg.Add(1)
-			semaphore <- struct{}{}
-			go func(host string, port int) {
-				defer wg.Done()
-				if scanHostPort(host, port) {
-					openPortsMutex.Lock()
-					openPorts[host] = append(openPorts[host], port)
-					openPortsMutex.Unlock()
-				}
-				<-semaphore
-			}(ip.String(), port)
-		}
+	hosts := newHostTable(hostParallelism)
+	connectScanner := &ConnectScanner{
+		Limiter: ratelimit.New(rate),
+		Hosts:   hosts,
+		Timing: Timing{
+			Initial: time.Duration(timeout) * time.Millisecond,
+			Min:     time.Duration(minTimeout) * time.Millisecond,
+			Max:     time.Duration(maxTimeout) * time.Millisecond,
+		},
+		Retries: retries,
+	}
 
-		if lastIP {
-			break
-		}
+	udpScanner := &UDPScanner{
+		Limiter: connectScanner.Limiter,
+		Hosts:   hosts,
+		Timing:  connectScanner.Timing,
+		Retries: retries,
 	}
-	wg.Wait()
 
-	for host, ports := range openPorts {
-		for _, port := range ports {
-			banner, err := grabBanner(host, port)
-			if err != nil {
-				fmt.Printf("Error grabbing banner for %s:%d: %v\n", host, port, err)
-			} else {
-				fmt.Printf("Banner for %s:%d: %s\n", host, port, banner)
-			}
+	var scanner PortScanner = connectScanner
+	switch scanType {
+	case "connect":
+	case "syn":
+		synScanner, err := newSynScanner(connectScanner)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "SYN scan unavailable (%v), falling back to connect scan\n", err)
+			break
 		}
+		defer synScanner.Close()
+		scanner = synScanner
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown scan type %q\n", scanType)
+		return
 	}
 
-	var results []HostResult
-
-	for host, ports := range openPorts {
-		var banners []BannerInfo
-		for _, port := range ports {
-			banner, err := grabBanner(host, port)
-			if err != nil {
-				banners = append(banners, BannerInfo{
-					Port:   port,
-					Banner: fmt.Sprintf("Error grabbing banner: %v", err),
-				})
-			} else {
-				banners = append(banners, BannerInfo{
-					Port:   port,
-					Banner: banner,
-				})
-			}
+	out := os.Stdout
+	if output != "" {
+		out, err = os.Create(output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating %s: %v\n", output, err)
+			return
 		}
-		results = append(results, HostResult{
-			Host:   host,
-			Ports:  ports,
-			Banner: banners,
-		})
+		defer out.Close()
 	}
-
-	// Serialize the results to JSON
-	jsonData, err := json.MarshalIndent(results, "", "  ")
+	writer, err := newResultWriter(format, out, strings.Join(os.Args, " "), targets.Len())
 	if err != nil {
-		fmt.Printf("Error serializing results: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error writing results: %v\n", err)
 		return
 	}
-
-	// Print the JSON serialized data
-	fmt.Println(string(jsonData))
-}
-
-func scanHostPort(host string, port int) bool {
-	address := fmt.Sprintf("%s:%d", host, port)
-	conn, err := net.DialTimeout("tcp", address, time.Second)
-	if err != nil {
-		return false
-	}
-	conn.Close()
-	fmt.Printf("Open port found: %s:%d\n", host, port) // Print details of open port
-	return true
-}
-
-func parsePortRange(start, end string) (int, int, error) {
-	startPort, err := strconv.Atoi(start)
-	if err != nil {
-		return 0, 0, err
+	writers := multiWriter{writer}
+	if logResults {
+		jsonLogger, err := jsonllogger.NewLogger(jsonllogger.LoggerConfig{
+			FilenamePrefix: "tcpscan",
+			LogDir:         "./logs",
+			MaxLines:       50000,
+			RotationTime:   30 * time.Minute,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening log: %v\n", err)
+			return
+		}
+		writers = append(writers, &logWriter{logger: jsonLogger})
 	}
-	endPort, err := strconv.Atoi(end)
-	if err != nil {
-		return 0, 0, err
+	if dbfile != "" {
+		dbWriter, err := newDBWriter(dbfile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening %s: %v\n", dbfile, err)
+			return
+		}
+		writers = append(writers, dbWriter)
 	}
-	if startPort < 0 || endPort < 0 || startPort > endPort {
-		return 0, 0, fmt.Errorf("invalid port range")
+	defer func() {
+		if err := writers.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing results: %v\n", err)
+		}
+	}()
+
+	var detector *ServiceDetector
+	if services {
+		detector = &ServiceDetector{
+			Limiter: connectScanner.Limiter,
+			Timeout: connectScanner.Timing.Max,
+			Wait:    time.Duration(serviceWait) * time.Millisecond,
+		}
 	}
-	return startPort, endPort, nil
-}
-
-func incrementIP(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		ip[j]++
-		if ip[j] != 0 {
-			break
+	var prober *TLSProber
+	if probeTLS {
+		prober = &TLSProber{
+			Limiter: connectScanner.Limiter,
+			Timeout: connectScanner.Timing.Max,
+			Wait:    5 * time.Second,
+		}
+		if serviceWait > 0 {
+			prober.Wait = time.Duration(serviceWait) * time.Millisecond
 		}
 	}
-}
-
-func grabBanner(host string, port int) (string, error) {
-	address := fmt.Sprintf("%s:%d", host, port)
-
-	// First, attempt to connect as if it's an HTTP server
-	serverVersion, err := attemptHTTPConnection(address)
-	if err == nil {
-		return serverVersion, nil
+	grabber := &BannerGrabber{
+		Limiter:  connectScanner.Limiter,
+		Timeout:  connectScanner.Timing.Max,
+		Greeting: time.Duration(bannerWait) * time.Millisecond,
+		Wait:     5 * time.Second,
+		MaxBytes: bannerBytes,
+		Encoding: bannerEncoding,
 	}
 
-	// If HTTP connection fails, fall back to generic TCP banner grabbing
-	return grabTCPPBanner(address)
-}
-
-func attemptHTTPConnection(address string) (string, error) {
-	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
-	if err != nil {
-		return "", err
+	// Progress is counted in ports scanned and reported on stderr, keeping
+	// stdout for the results.
+	var scanned, open, hostsUp atomic.Int64
+	totalPorts := int64(targets.Len()) * int64(len(ports.TCP)+len(ports.UDP))
+	if progress > 0 {
+		ticker := time.NewTicker(time.Duration(progress) * time.Second)
+		defer ticker.Stop()
+		go func() {
+			for range ticker.C {
+				fmt.Fprintf(os.Stderr, "progress: %d/%d ports scanned, %d open, %d hosts up\n",
+					scanned.Load(), totalPorts, open.Load(), hostsUp.Load())
+			}
+		}()
 	}
-	defer conn.Close()
 
-	// Send a basic HTTP GET request
-	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", address)
+	semaphore := make(chan struct{}, concurrency) // Limit concurrent goroutines
+	// parallel runs task(0) to task(n-1) concurrently, within the limit.
+	parallel := func(n int, task func(i int)) {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			semaphore <- struct{}{}
+			go func(i int) {
+				defer wg.Done()
+				task(i)
+				<-semaphore
+			}(i)
+		}
+		wg.Wait()
+	}
 
-	// Set a deadline for reading the response
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// Results are written as soon as each host is done, by one writer at a
+	// time. Scanning stops at the first write error.
+	var writeMu sync.Mutex
+	var writeErr error
+	write := func(result HostResult) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if writeErr != nil {
+			return
+		}
+		if writeErr = writers.Write(result); writeErr != nil {
+			fmt.Fprintf(os.Stderr, "Error writing results: %v\n", writeErr)
+		}
+	}
+	failed := func() bool {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return writeErr != nil
+	}
 
-	scanner := bufio.NewScanner(conn)
-	if scanner.Scan() {
-		response := scanner.Text()
+	// finish identifies the services, collects the TLS configurations and
+	// grabs the banners of a host's open ports, then writes its result.
+	var hostsWG sync.WaitGroup
+	finish := func(host string, portList []PortResult) {
+		defer hostsWG.Done()
+		sort.Slice(portList, func(i, j int) bool { return portList[i].Port < portList[j].Port })
+
+		result := HostResult{
+			Host:  host,
+			Ports: []int{},
+			RTTMs: milliseconds(hosts.get(host).rtt()),
+		}
+		var udpOpen []PortResult
+		for _, port := range portList {
+			switch {
+			case port.Protocol == "tcp" && port.State == StateOpen:
+				result.Ports = append(result.Ports, port.Port)
+			case port.Protocol == "tcp" && port.State == StateClosed:
+				result.Closed = append(result.Closed, port.Port)
+			case port.Protocol == "tcp":
+				result.Filtered = append(result.Filtered, port.Port)
+			case port.State == StateOpen:
+				result.UDPPorts = append(result.UDPPorts, port.Port)
+				udpOpen = append(udpOpen, port)
+			case port.State == StateClosed:
+				result.UDPClosed = append(result.UDPClosed, port.Port)
+			case port.State == StateOpenFiltered:
+				result.UDPOpenFiltered = append(result.UDPOpenFiltered, port.Port)
+			default:
+				result.UDPFiltered = append(result.UDPFiltered, port.Port)
+			}
+		}
+		// Hosts that answered on any port are up.
+		if len(result.Ports)+len(result.Closed)+len(result.UDPPorts)+len(result.UDPClosed) == 0 {
+			return
+		}
+		hostsUp.Add(1)
+		name := serverName(targets, host)
+
+		identified := make(map[int]ServiceInfo)
+		if detector != nil {
+			services := make([]ServiceInfo, len(result.Ports))
+			parallel(len(result.Ports), func(i int) {
+				services[i] = detector.Detect(host, result.Ports[i])
+				fmt.Fprintf(os.Stderr, "Service on %s:%d/tcp: %s\n", host, result.Ports[i], services[i])
+			})
+			for i, info := range services {
+				identified[result.Ports[i]] = info
+			}
+			result.Services = services
+			for _, port := range udpOpen {
+				result.Services = append(result.Services, udpService(port))
+			}
+		}
 
-		// If the response is an HTTP response, look for the Server header
-		if strings.HasPrefix(response, "HTTP/") {
-			for scanner.Scan() {
-				line := scanner.Text()
-				if strings.HasPrefix(line, "Server:") {
-					return strings.TrimSpace(strings.TrimPrefix(line, "Server:")), nil
+		if prober != nil {
+			type tlsPort struct {
+				port     int
+				starttls string
+			}
+			var tlsPorts []tlsPort
+			for _, port := range result.Ports {
+				if starttls, ok := tlsMode(port, identified[port]); ok {
+					tlsPorts = append(tlsPorts, tlsPort{port, starttls})
 				}
 			}
+			result.TLS = make([]TLSInfo, len(tlsPorts))
+			parallel(len(tlsPorts), func(i int) {
+				port := tlsPorts[i].port
+				info := prober.Probe(host, name, port, tlsPorts[i].starttls)
+				if info.Error == "" {
+					fmt.Fprintf(os.Stderr, "TLS on %s:%d: %s %s\n", host, port, info.Version, info.Cipher)
+				} else {
+					fmt.Fprintf(os.Stderr, "TLS handshake with %s:%d failed: %s\n", host, port, info.Error)
+				}
+				result.TLS[i] = info
+			})
 		}
-	}
-	if err := scanner.Err(); err != nil {
-		return "", err
-	}
 
-	return "", fmt.Errorf("no HTTP server detected")
-}
+		result.Banner = make([]BannerInfo, len(result.Ports))
+		parallel(len(result.Ports), func(i int) {
+			port := result.Ports[i]
+			starttls, ok := tlsMode(port, identified[port])
+			result.Banner[i] = grabber.Grab(host, name, port, ok && starttls == "")
+			fmt.Fprintf(os.Stderr, "Banner for %s:%d: %s\n", host, port, result.Banner[i].Banner)
+		})
+		for _, port := range udpOpen {
+			result.Banner = append(result.Banner, grabber.udpBanner(port))
+		}
 
-func grabTCPPBanner(address string) (string, error) {
-	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
-	if err != nil {
-		return "", err
+		write(result)
+	}
+
+	// hostScan collects the port results of a host until all of its ports
+	// are scanned.
+	type hostScan struct {
+		host    string
+		pending int
+		ports   []PortResult
+	}
+	var scansMu sync.Mutex
+	scan := func(scanner PortScanner, h *hostScan, port int) {
+		semaphore <- struct{}{}
+		go func() {
+			result := scanner.Scan(h.host, port)
+			<-semaphore
+			scanned.Add(1)
+			if result.State == StateOpen {
+				open.Add(1)
+				fmt.Fprintf(os.Stderr, "Open port found: %s:%d/%s\n", h.host, port, result.Protocol) // Print details of open port
+			}
+			scansMu.Lock()
+			h.ports = append(h.ports, result)
+			h.pending--
+			done := h.pending == 0
+			scansMu.Unlock()
+			if done {
+				finish(h.host, h.ports)
+			}
+		}()
 	}
-	defer conn.Close()
 
-	// Set a deadline for reading the response
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// Hosts are scanned in groups, one port across the group at a time, so
+	// that attempts are spread over hosts instead of hitting one host with
+	// every port at once. Each host is finished and written as soon as its
+	// own ports are scanned.
+	order := target.NewPermutation(targets.Len(), seed, random)
+	for first := uint64(0); first < targets.Len() && !failed(); first += uint64(hostGroup) {
+		var group []*hostScan
+		for i := first; i < targets.Len() && i < first+uint64(hostGroup); i++ {
+			ip := targets.At(order.At(i))
+			fmt.Fprintf(os.Stderr, "scanning: %s\n", ip.String())
+			group = append(group, &hostScan{host: ip.String(), pending: len(ports.TCP) + len(ports.UDP)})
+		}
+		hostsWG.Add(len(group))
 
-	scanner := bufio.NewScanner(conn)
-	if scanner.Scan() {
-		return scanner.Text(), nil
+		for _, port := range ports.TCP {
+			for _, h := range group {
+				scan(scanner, h, port)
+			}
+		}
+		for _, port := range ports.UDP {
+			for _, h := range group {
+				scan(udpScanner, h, port)
+			}
+		}
 	}
-	if err := scanner.Err(); err != nil {
-		return "", err
+	hostsWG.Wait()
+	fmt.Fprintf(os.Stderr, "done: %d ports scanned, %d open, %d hosts up\n", scanned.Load(), open.Load(), hostsUp.Load())
+}
+
+// serverName returns the hostname host was given as in the targets, sent as
+// TLS SNI, or "" for hosts given as addresses.
+func serverName(targets *target.List, host string) string {
+	if names := targets.Names(net.ParseIP(host)); len(names) > 0 {
+		return names[0]
 	}
+	return ""
+}
 
-	return "", fmt.Errorf("no banner received")
+// printable returns b with bytes other than printable ASCII replaced by dots.
+func printable(b []byte) string {
+	out := make([]byte, len(b))
+	for i, c := range b {
+		if c < 0x20 || c > 0x7e {
+			c = '.'
+		}
+		out[i] = c
+	}
+	return string(out)
 }
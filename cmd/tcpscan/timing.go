@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Timing bounds the timeouts of connection attempts.
+type Timing struct {
+	Initial time.Duration // timeout until a host's round trip time is measured
+	Min     time.Duration
+	Max     time.Duration
+}
+
+// hostState tracks the round trip time and the attempts in flight for one
+// host.
+type hostState struct {
+	slots chan struct{} // nil when the parallelism per host is not capped
+
+	mu      sync.Mutex
+	srtt    time.Duration // smoothed round trip time
+	rttvar  time.Duration // round trip time variation
+	samples int
+}
+
+// hostTable holds the state of every host scanned.
+type hostTable struct {
+	parallelism int // attempts in flight per host, 0 for no cap
+
+	mu    sync.Mutex
+	hosts map[string]*hostState
+}
+
+func newHostTable(parallelism int) *hostTable {
+	return &hostTable{parallelism: parallelism, hosts: make(map[string]*hostState)}
+}
+
+// get returns the state of host, creating it on first use.
+func (t *hostTable) get(host string) *hostState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.hosts[host]
+	if !ok {
+		h = &hostState{}
+		if t.parallelism > 0 {
+			h.slots = make(chan struct{}, t.parallelism)
+		}
+		t.hosts[host] = h
+	}
+	return h
+}
+
+// acquire blocks until an attempt to the host may start.
+func (h *hostState) acquire() {
+	if h.slots != nil {
+		h.slots <- struct{}{}
+	}
+}
+
+// release ends an attempt started with acquire.
+func (h *hostState) release() {
+	if h.slots != nil {
+		<-h.slots
+	}
+}
+
+// observe adds a measured round trip time, smoothed as in TCP (RFC 6298).
+func (h *hostState) observe(rtt time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.samples == 0 {
+		h.srtt, h.rttvar = rtt, rtt/2
+	} else {
+		delta := h.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		h.rttvar = (3*h.rttvar + delta) / 4
+		h.srtt = (7*h.srtt + rtt) / 8
+	}
+	h.samples++
+}
+
+// rtt returns the smoothed round trip time, 0 when none was measured.
+func (h *hostState) rtt() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.srtt
+}
+
+// timeout returns the timeout of the given attempt, starting at 0: the
+// smoothed round trip time plus four times its variation once measured, the
+// initial timeout before, doubled for every retry and kept within bounds.
+func (h *hostState) timeout(timing Timing, attempt int) time.Duration {
+	h.mu.Lock()
+	timeout := timing.Initial
+	if h.samples > 0 {
+		timeout = h.srtt + 4*h.rttvar
+	}
+	h.mu.Unlock()
+
+	timeout <<= uint(attempt)
+	if timeout < timing.Min {
+		timeout = timing.Min
+	}
+	if timeout > timing.Max {
+		timeout = timing.Max
+	}
+	return timeout
+}
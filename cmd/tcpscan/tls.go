@@ -0,0 +1,656 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/clwg/netsecutils/pkg/ratelimit"
+)
+
+// tlsPorts are the ports of services speaking TLS from the start.
+var tlsPorts = []int{443, 465, 636, 853, 989, 990, 992, 993, 994, 995, 4443, 5061, 5223, 6697, 8443, 9443}
+
+// startTLSPorts are the ports of services upgrading connections to TLS, by
+// protocol.
+var startTLSPorts = map[int]string{21: "ftp", 25: "smtp", 110: "pop3", 143: "imap", 587: "smtp", 5222: "xmpp"}
+
+// tlsServices are the names of services speaking TLS from the start.
+var tlsServices = map[string]bool{
+	"ssl": true, "https": true, "https-alt": true, "smtps": true, "imaps": true, "pop3s": true, "ldapssl": true,
+}
+
+// startTLSServices maps the names of services upgrading connections to TLS to
+// their protocol.
+var startTLSServices = map[string]string{
+	"ftp": "ftp", "smtp": "smtp", "submission": "smtp", "pop3": "pop3", "imap": "imap", "xmpp-client": "xmpp",
+}
+
+// helloSuites are the cipher suites offered by crafted ClientHellos.
+var helloSuites = []uint16{0xc02f, 0xc030, 0xc02b, 0xc02c, 0xcca8, 0xcca9, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035, 0x000a}
+
+// weakSuites are cipher suites with NULL, export, anonymous, DES, RC4 or
+// 3DES ciphers.
+var weakSuites = []struct {
+	ID   uint16
+	Name string
+}{
+	{0x0001, "TLS_RSA_WITH_NULL_MD5"},
+	{0x0002, "TLS_RSA_WITH_NULL_SHA"},
+	{0x003b, "TLS_RSA_WITH_NULL_SHA256"},
+	{0x0003, "TLS_RSA_EXPORT_WITH_RC4_40_MD5"},
+	{0x0008, "TLS_RSA_EXPORT_WITH_DES40_CBC_SHA"},
+	{0x0014, "TLS_DHE_RSA_EXPORT_WITH_DES40_CBC_SHA"},
+	{0x0009, "TLS_RSA_WITH_DES_CBC_SHA"},
+	{0x0015, "TLS_DHE_RSA_WITH_DES_CBC_SHA"},
+	{0x0018, "TLS_DH_anon_WITH_RC4_128_MD5"},
+	{0x001b, "TLS_DH_anon_WITH_3DES_EDE_CBC_SHA"},
+	{0x0034, "TLS_DH_anon_WITH_AES_128_CBC_SHA"},
+	{0x003a, "TLS_DH_anon_WITH_AES_256_CBC_SHA"},
+	{0x0004, "TLS_RSA_WITH_RC4_128_MD5"},
+	{0x0005, "TLS_RSA_WITH_RC4_128_SHA"},
+	{0xc007, "TLS_ECDHE_ECDSA_WITH_RC4_128_SHA"},
+	{0xc011, "TLS_ECDHE_RSA_WITH_RC4_128_SHA"},
+	{0x000a, "TLS_RSA_WITH_3DES_EDE_CBC_SHA"},
+	{0x0016, "TLS_DHE_RSA_WITH_3DES_EDE_CBC_SHA"},
+	{0xc012, "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA"},
+}
+
+// tlsHello is a crafted ClientHello.
+type tlsHello struct {
+	Version uint16
+	Suites  []uint16
+	ALPN    []string
+}
+
+// fingerprintHellos are sent to fingerprint a TLS server by its choices,
+// as JARM does, and to find the old versions and weak cipher suites it
+// accepts.
+var fingerprintHellos = []tlsHello{
+	{Version: tls.VersionTLS12, Suites: helloSuites, ALPN: []string{"h2", "http/1.1"}},
+	{Version: tls.VersionTLS12, Suites: reversed(helloSuites)},
+	{Version: tls.VersionTLS12, Suites: []uint16{0x009c, 0x009d, 0x003c, 0x003d, 0x002f, 0x0035}}, // RSA key exchange
+	{Version: tls.VersionTLS11, Suites: helloSuites},
+	{Version: tls.VersionTLS10, Suites: helloSuites},
+	{Version: tls.VersionSSL30, Suites: append([]uint16{0x002f, 0x0035, 0x000a}, weakSuiteIDs()...)},
+	{Version: tls.VersionTLS12, Suites: weakSuiteIDs()},
+}
+
+// TLSInfo is the TLS configuration of a port.
+type TLSInfo struct {
+	Port         int        `json:"port"`
+	ServerName   string     `json:"server_name,omitempty"`
+	StartTLS     string     `json:"starttls,omitempty"`
+	Version      string     `json:"version,omitempty"`
+	Cipher       string     `json:"cipher,omitempty"`
+	ALPN         string     `json:"alpn,omitempty"`
+	JA3S         string     `json:"ja3s,omitempty"`
+	JA3SString   string     `json:"ja3s_string,omitempty"`
+	Fingerprint  string     `json:"fingerprint,omitempty"`
+	Certificates []CertInfo `json:"certificates,omitempty"`
+	Trusted      bool       `json:"trusted"`
+	Findings     []string   `json:"findings,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// CertInfo describes a certificate of the chain a server presented.
+type CertInfo struct {
+	Subject            string    `json:"subject"`
+	Issuer             string    `json:"issuer"`
+	SANs               []string  `json:"sans,omitempty"`
+	SerialNumber       string    `json:"serial_number"`
+	NotBefore          time.Time `json:"not_before"`
+	NotAfter           time.Time `json:"not_after"`
+	SignatureAlgorithm string    `json:"signature_algorithm"`
+	PublicKey          string    `json:"public_key"`
+	SHA1               string    `json:"sha1"`
+	SHA256             string    `json:"sha256"`
+}
+
+// TLSProber collects the TLS configuration of ports.
+type TLSProber struct {
+	Limiter *ratelimit.Limiter
+	Timeout time.Duration // connection timeout
+	Wait    time.Duration // time to wait for a handshake or STARTTLS exchange
+}
+
+// Probe completes a handshake with host:port, upgrading the connection with
+// the STARTTLS exchange of the starttls protocol when set, then sends the
+// fingerprinting ClientHellos. Every handshake sends serverName as SNI when
+// set, so virtual hosts present the certificate of that name.
+func (p *TLSProber) Probe(host, serverName string, port int, starttls string) TLSInfo {
+	info := TLSInfo{Port: port, ServerName: serverName, StartTLS: starttls}
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+
+	conn, err := p.dial(address, host, starttls)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	rec := &recordingConn{Conn: conn}
+	client := tls.Client(rec, &tls.Config{
+		InsecureSkipVerify: true, // the chain is verified separately
+		ServerName:         serverName,
+		MinVersion:         tls.VersionTLS10,
+		CipherSuites:       allSuites(),
+		NextProtos:         []string{"h2", "http/1.1"},
+	})
+	client.SetDeadline(time.Now().Add(p.Wait))
+	err = client.Handshake()
+	conn.Close()
+	if err != nil {
+		info.Error = err.Error()
+	} else {
+		state := client.ConnectionState()
+		info.Version = tls.VersionName(state.Version)
+		info.Cipher = cipherName(state.CipherSuite)
+		info.ALPN = state.NegotiatedProtocol
+		for _, cert := range state.PeerCertificates {
+			info.Certificates = append(info.Certificates, certInfo(cert))
+		}
+		checkSuite(&info, state.Version, state.CipherSuite)
+		checkChain(&info, state.PeerCertificates, serverName)
+	}
+	if hello, err := parseServerHello(rec.buf); err == nil {
+		info.JA3SString = hello.ja3s()
+		sum := md5.Sum([]byte(info.JA3SString))
+		info.JA3S = hex.EncodeToString(sum[:])
+	}
+
+	answers := make([]string, len(fingerprintHellos))
+	answered := false
+	for i, h := range fingerprintHellos {
+		hello, err := p.hello(address, host, serverName, starttls, h)
+		if err != nil {
+			answers[i] = "|||"
+			continue
+		}
+		answered = true
+		answers[i] = fmt.Sprintf("%04x|%04x|%s|%s", hello.cipher, hello.version, hello.alpn, hello.extensionList())
+		checkSuite(&info, hello.version, hello.cipher)
+	}
+	if answered {
+		sum := sha256.Sum256([]byte(strings.Join(answers, ",")))
+		info.Fingerprint = hex.EncodeToString(sum[:16])
+	}
+	return info
+}
+
+// dial connects to address, upgrading the connection with the STARTTLS
+// exchange of the starttls protocol when set.
+func (p *TLSProber) dial(address, host, starttls string) (net.Conn, error) {
+	p.Limiter.Wait()
+	conn, err := net.DialTimeout("tcp", address, p.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if starttls != "" {
+		conn.SetDeadline(time.Now().Add(p.Wait))
+		if err := startTLS(conn, starttls, host); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("STARTTLS: %w", err)
+		}
+		conn.SetDeadline(time.Time{})
+	}
+	return conn, nil
+}
+
+// hello sends h to address and parses the ServerHello answering it.
+func (p *TLSProber) hello(address, host, serverName, starttls string, h tlsHello) (serverHello, error) {
+	conn, err := p.dial(address, host, starttls)
+	if err != nil {
+		return serverHello{}, err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(p.Wait))
+	if _, err := conn.Write(clientHello(h.Version, h.Suites, h.ALPN, serverName)); err != nil {
+		return serverHello{}, err
+	}
+	answer, _ := readAnswer(conn, p.Wait, maxAnswer)
+	return parseServerHello(answer)
+}
+
+// checkSuite records findings about a negotiated version and cipher suite.
+func checkSuite(info *TLSInfo, version, suite uint16) {
+	if version < tls.VersionTLS12 {
+		info.addFinding("accepts " + tls.VersionName(version))
+	}
+	name := cipherName(suite)
+	for _, weak := range weakSuites {
+		if weak.ID == suite {
+			info.addFinding("accepts weak cipher suite " + name)
+		}
+	}
+	if strings.HasPrefix(name, "TLS_RSA_") {
+		info.addFinding("accepts cipher suites without forward secrecy")
+	}
+}
+
+// checkChain verifies a chain against the system roots and, when given,
+// serverName, and records findings about its certificates.
+func checkChain(info *TLSInfo, certs []*x509.Certificate, serverName string) {
+	if len(certs) == 0 {
+		return
+	}
+	leaf := certs[0]
+	now := time.Now()
+	switch {
+	case now.After(leaf.NotAfter):
+		info.addFinding("certificate expired on " + leaf.NotAfter.Format("2006-01-02"))
+	case now.Before(leaf.NotBefore):
+		info.addFinding("certificate not valid before " + leaf.NotBefore.Format("2006-01-02"))
+	case leaf.NotAfter.Sub(now) < 30*24*time.Hour:
+		info.addFinding("certificate expires on " + leaf.NotAfter.Format("2006-01-02"))
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{Intermediates: intermediates, DNSName: serverName})
+	info.Trusted = err == nil
+	// The validity of the leaf is reported above.
+	var invalid x509.CertificateInvalidError
+	leafExpired := errors.As(err, &invalid) && invalid.Cert == leaf && invalid.Reason == x509.Expired
+	switch {
+	case bytes.Equal(leaf.RawIssuer, leaf.RawSubject) && leaf.CheckSignatureFrom(leaf) == nil:
+		info.addFinding("self-signed certificate")
+	case err != nil && !leafExpired:
+		info.addFinding("certificate not trusted: " + err.Error())
+	}
+
+	for _, cert := range certs {
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok && key.N.BitLen() < 2048 {
+			info.addFinding(fmt.Sprintf("weak %d bit RSA key: %s", key.N.BitLen(), cert.Subject))
+		}
+		// The signatures of roots are not checked by clients.
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert != leaf {
+			continue
+		}
+		switch cert.SignatureAlgorithm {
+		case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+			info.addFinding(fmt.Sprintf("weak %s signature: %s", cert.SignatureAlgorithm, cert.Subject))
+		}
+	}
+}
+
+// addFinding records finding once.
+func (info *TLSInfo) addFinding(finding string) {
+	for _, f := range info.Findings {
+		if f == finding {
+			return
+		}
+	}
+	info.Findings = append(info.Findings, finding)
+}
+
+// certInfo describes cert.
+func certInfo(cert *x509.Certificate) CertInfo {
+	info := CertInfo{
+		Subject:            cert.Subject.String(),
+		Issuer:             cert.Issuer.String(),
+		SANs:               cert.DNSNames,
+		SerialNumber:       cert.SerialNumber.Text(16),
+		NotBefore:          cert.NotBefore,
+		NotAfter:           cert.NotAfter,
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		PublicKey:          cert.PublicKeyAlgorithm.String(),
+	}
+	for _, ip := range cert.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		info.SANs = append(info.SANs, email)
+	}
+	for _, uri := range cert.URIs {
+		info.SANs = append(info.SANs, uri.String())
+	}
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		info.PublicKey = fmt.Sprintf("RSA %d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		info.PublicKey = "ECDSA " + key.Curve.Params().Name
+	case ed25519.PublicKey:
+		info.PublicKey = "Ed25519"
+	}
+	sha1Sum := sha1.Sum(cert.Raw)
+	sha256Sum := sha256.Sum256(cert.Raw)
+	info.SHA1 = hex.EncodeToString(sha1Sum[:])
+	info.SHA256 = hex.EncodeToString(sha256Sum[:])
+	return info
+}
+
+// startTLS upgrades conn with the STARTTLS exchange of protocol.
+func startTLS(conn net.Conn, protocol, host string) error {
+	r := bufio.NewReader(conn)
+	switch protocol {
+	case "smtp":
+		if err := readReply(r, "220"); err != nil {
+			return err
+		}
+		fmt.Fprint(conn, "EHLO tcpscan\r\n")
+		if err := readReply(r, "250"); err != nil {
+			return err
+		}
+		fmt.Fprint(conn, "STARTTLS\r\n")
+		return readReply(r, "220")
+	case "ftp":
+		if err := readReply(r, "220"); err != nil {
+			return err
+		}
+		fmt.Fprint(conn, "AUTH TLS\r\n")
+		return readReply(r, "234")
+	case "pop3":
+		if err := expectLine(r, "", "+OK"); err != nil {
+			return err
+		}
+		fmt.Fprint(conn, "STLS\r\n")
+		return expectLine(r, "", "+OK")
+	case "imap":
+		if err := expectLine(r, "", "* OK"); err != nil {
+			return err
+		}
+		fmt.Fprint(conn, "a001 STARTTLS\r\n")
+		return expectLine(r, "a001 ", "a001 OK")
+	case "xmpp":
+		fmt.Fprintf(conn, "<?xml version='1.0'?><stream:stream to='%s' xmlns='jabber:client' "+
+			"xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>", host)
+		if err := readUntil(r, "</stream:features>"); err != nil {
+			return err
+		}
+		fmt.Fprint(conn, "<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>")
+		return readUntil(r, "<proceed")
+	}
+	return fmt.Errorf("unknown protocol %q", protocol)
+}
+
+// readReply reads an SMTP or FTP reply, which may span lines, and checks its
+// code.
+func readReply(r *bufio.Reader, code string) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		// The last line of a reply has a space after the code.
+		if len(line) < 4 || line[3] != ' ' || strings.Trim(line[:3], "0123456789") != "" {
+			continue
+		}
+		if !strings.HasPrefix(line, code) {
+			return fmt.Errorf("unexpected reply %q", strings.TrimSpace(line))
+		}
+		return nil
+	}
+}
+
+// expectLine reads lines until one starts with tag and checks that it starts
+// with want.
+func expectLine(r *bufio.Reader, tag, want string) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, tag) {
+			continue
+		}
+		if !strings.HasPrefix(line, want) {
+			return fmt.Errorf("unexpected reply %q", strings.TrimSpace(line))
+		}
+		return nil
+	}
+}
+
+// readUntil reads XML until marker, failing on a stream error or the end of
+// the stream.
+func readUntil(r *bufio.Reader, marker string) error {
+	var read strings.Builder
+	for read.Len() < maxAnswer {
+		chunk, err := r.ReadString('>')
+		if err != nil {
+			return err
+		}
+		read.WriteString(chunk)
+		s := read.String()
+		switch {
+		case strings.Contains(s, marker):
+			return nil
+		case strings.Contains(s, "<failure"), strings.Contains(s, "<stream:error"), strings.Contains(s, "</stream:stream>"):
+			return fmt.Errorf("refused: %q", s)
+		}
+	}
+	return errors.New("answer too long")
+}
+
+// recordingConn records the bytes read from a connection, up to maxAnswer.
+type recordingConn struct {
+	net.Conn
+	buf []byte
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if len(c.buf) < maxAnswer {
+		c.buf = append(c.buf, b[:n]...)
+	}
+	return n, err
+}
+
+// serverHello holds the fields of a ServerHello.
+type serverHello struct {
+	legacyVersion uint16 // version field, TLS 1.2 for TLS 1.3
+	version       uint16 // negotiated version
+	cipher        uint16
+	extensions    []uint16
+	alpn          string
+}
+
+// parseServerHello parses the ServerHello starting the records a server
+// sent.
+func parseServerHello(b []byte) (serverHello, error) {
+	var h serverHello
+	var msgs []byte
+	for len(b) >= 5 && b[0] == 0x16 {
+		n := int(binary.BigEndian.Uint16(b[3:5]))
+		if len(b) < 5+n {
+			msgs = append(msgs, b[5:]...)
+			break
+		}
+		msgs = append(msgs, b[5:5+n]...)
+		b = b[5+n:]
+	}
+	if len(msgs) == 0 && len(b) >= 7 && b[0] == 0x15 {
+		return h, fmt.Errorf("alert %d", b[6])
+	}
+	if len(msgs) < 4 || msgs[0] != 0x02 {
+		return h, errors.New("no ServerHello")
+	}
+	n := int(msgs[1])<<16 | int(msgs[2])<<8 | int(msgs[3])
+	if len(msgs) < 4+n || n < 35 {
+		return h, errors.New("truncated ServerHello")
+	}
+	body := msgs[4 : 4+n]
+
+	h.legacyVersion = binary.BigEndian.Uint16(body)
+	h.version = h.legacyVersion
+	off := 35 + int(body[34]) // version, random and session ID
+	if len(body) < off+3 {
+		return h, errors.New("truncated ServerHello")
+	}
+	h.cipher = binary.BigEndian.Uint16(body[off:])
+	off += 3 // cipher suite and compression method
+	if len(body) < off+2 {
+		return h, nil
+	}
+	exts := body[off+2:]
+	for len(exts) >= 4 {
+		extType := binary.BigEndian.Uint16(exts)
+		l := int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+l {
+			break
+		}
+		data := exts[4 : 4+l]
+		h.extensions = append(h.extensions, extType)
+		switch {
+		case extType == 0x0010 && l >= 3 && l >= 3+int(data[2]): // ALPN
+			h.alpn = string(data[3 : 3+int(data[2])])
+		case extType == 0x002b && l == 2: // supported versions
+			h.version = binary.BigEndian.Uint16(data)
+		}
+		exts = exts[4+l:]
+	}
+	return h, nil
+}
+
+// ja3s returns the JA3S string of h: its version, cipher suite and
+// extensions in decimal.
+func (h serverHello) ja3s() string {
+	return fmt.Sprintf("%d,%d,%s", h.legacyVersion, h.cipher, h.extensionList())
+}
+
+// extensionList returns the extensions of h in decimal, joined by dashes.
+func (h serverHello) extensionList() string {
+	exts := make([]string, len(h.extensions))
+	for i, ext := range h.extensions {
+		exts[i] = strconv.Itoa(int(ext))
+	}
+	return strings.Join(exts, "-")
+}
+
+// clientHello returns a ClientHello for version offering suites, and the
+// ALPN protocols and server name when given.
+func clientHello(version uint16, suites []uint16, alpn []string, serverName string) []byte {
+	var extensions []byte
+	if serverName != "" && version >= tls.VersionTLS10 {
+		entry := binary.BigEndian.AppendUint16([]byte{0x00}, uint16(len(serverName))) // host_name
+		entry = append(entry, serverName...)
+		data := binary.BigEndian.AppendUint16(nil, uint16(len(entry)))
+		extensions = appendExtension(extensions, 0x0000, append(data, entry...)) // server name
+	}
+	if version >= tls.VersionTLS10 {
+		extensions = appendExtension(extensions, 0x000a, []byte{0x00, 0x06, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x18}) // supported groups
+		extensions = appendExtension(extensions, 0x000b, []byte{0x01, 0x00})                                     // EC point formats
+		extensions = appendExtension(extensions, 0xff01, []byte{0x00})                                           // renegotiation info
+	}
+	if version >= tls.VersionTLS12 {
+		extensions = appendExtension(extensions, 0x000d, []byte{0x00, 0x14,
+			0x04, 0x03, 0x05, 0x03, 0x06, 0x03, 0x08, 0x04, 0x08, 0x05,
+			0x08, 0x06, 0x04, 0x01, 0x05, 0x01, 0x06, 0x01, 0x02, 0x01}) // signature algorithms
+	}
+	if len(alpn) > 0 {
+		var list []byte
+		for _, proto := range alpn {
+			list = append(list, byte(len(proto)))
+			list = append(list, proto...)
+		}
+		data := binary.BigEndian.AppendUint16(nil, uint16(len(list)))
+		extensions = appendExtension(extensions, 0x0010, append(data, list...)) // ALPN
+	}
+
+	random := make([]byte, 32)
+	rand.Read(random)
+	body := binary.BigEndian.AppendUint16(nil, version)
+	body = append(body, random...)
+	body = append(body, 0x00) // session ID
+	body = binary.BigEndian.AppendUint16(body, uint16(2*len(suites)))
+	for _, suite := range suites {
+		body = binary.BigEndian.AppendUint16(body, suite)
+	}
+	body = append(body, 0x01, 0x00) // null compression
+	if len(extensions) > 0 {
+		body = binary.BigEndian.AppendUint16(body, uint16(len(extensions)))
+		body = append(body, extensions...)
+	}
+
+	handshake := []byte{0x01, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	handshake = append(handshake, body...)
+
+	record := []byte{0x16, 0x03, 0x01}
+	if version == tls.VersionSSL30 {
+		record[2] = 0x00
+	}
+	record = binary.BigEndian.AppendUint16(record, uint16(len(handshake)))
+	return append(record, handshake...)
+}
+
+// appendExtension appends a TLS extension.
+func appendExtension(b []byte, extType uint16, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, extType)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+// tlsMode returns whether port is probed for TLS and the STARTTLS protocol
+// upgrading its connections, from the service identified on it or otherwise
+// the port number.
+func tlsMode(port int, service ServiceInfo) (string, bool) {
+	if tlsServices[service.Service] {
+		return "", true
+	}
+	if protocol, ok := startTLSServices[service.Service]; ok {
+		return protocol, true
+	}
+	if service.Confidence == ConfidenceProbed {
+		// Another service answered.
+		return "", false
+	}
+	if hasPort(tlsPorts, port) {
+		return "", true
+	}
+	protocol, ok := startTLSPorts[port]
+	return protocol, ok
+}
+
+// cipherName returns the IANA name of a cipher suite.
+func cipherName(id uint16) string {
+	for _, weak := range weakSuites {
+		if weak.ID == id {
+			return weak.Name
+		}
+	}
+	return tls.CipherSuiteName(id)
+}
+
+// allSuites returns every cipher suite crypto/tls implements, so handshakes
+// succeed with servers accepting only insecure ones.
+func allSuites() []uint16 {
+	var ids []uint16
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		ids = append(ids, suite.ID)
+	}
+	return ids
+}
+
+// weakSuiteIDs returns the IDs of weakSuites.
+func weakSuiteIDs() []uint16 {
+	ids := make([]uint16, len(weakSuites))
+	for i, suite := range weakSuites {
+		ids[i] = suite.ID
+	}
+	return ids
+}
+
+// reversed returns a reversed copy of suites.
+func reversed(suites []uint16) []uint16 {
+	out := make([]uint16, len(suites))
+	for i, suite := range suites {
+		out[len(suites)-1-i] = suite
+	}
+	return out
+}
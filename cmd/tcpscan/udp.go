@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/clwg/netsecutils/pkg/ratelimit"
+)
+
+// StateOpenFiltered is a UDP port that did not answer: either open with a
+// service ignoring the probe, or filtered.
+const StateOpenFiltered = "open|filtered"
+
+// UDPScanner scans UDP ports with protocol-specific probes. An answer marks
+// the port open and an ICMP port unreachable marks it closed, which a
+// connected UDP socket reports as a refused read.
+type UDPScanner struct {
+	Limiter *ratelimit.Limiter
+	Hosts   *hostTable
+	Timing  Timing
+	Retries int // additional probes when unanswered
+}
+
+// Scan probes host:port, resending the probe with a doubled timeout while
+// unanswered.
+func (s *UDPScanner) Scan(host string, port int) PortResult {
+	result := PortResult{Port: port, Protocol: "udp", State: StateOpenFiltered}
+
+	conn, err := net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		result.State = StateFiltered
+		return result
+	}
+	defer conn.Close()
+
+	h := s.Hosts.get(host)
+	name, payload := payloadFor(port)
+	result.Service = name
+	buf := make([]byte, 2048)
+
+	for attempt := 0; attempt <= s.Retries; attempt++ {
+		s.Limiter.Wait()
+		h.acquire()
+		start := time.Now()
+		conn.SetDeadline(start.Add(h.timeout(s.Timing, attempt)))
+		_, err := conn.Write(payload)
+		var n int
+		if err == nil {
+			n, err = conn.Read(buf)
+		}
+		rtt := time.Since(start)
+		h.release()
+		result.Attempts++
+
+		if err == nil {
+			h.observe(rtt)
+			result.State, result.RTT = StateOpen, rtt
+			result.Response = append([]byte(nil), buf[:n]...)
+			return result
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			h.observe(rtt)
+			result.State, result.RTT = StateClosed, rtt
+			return result
+		}
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			// Host or network unreachable, or administratively
+			// prohibited.
+			result.State = StateFiltered
+			return result
+		}
+	}
+	return result
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// udpPayload is a probe that services on the given ports answer.
+type udpPayload struct {
+	Name  string
+	Ports []int
+	Hex   string // payload bytes, whitespace is ignored
+}
+
+// udpPayloads are sent to their ports; other ports get an empty datagram.
+var udpPayloads = []udpPayload{
+	{
+		// version.bind TXT CH query.
+		Name:  "dns",
+		Ports: []int{53},
+		Hex:   "1234 0100 0001 0000 0000 0000 0776657273696f6e 0462696e64 00 0010 0003",
+	},
+	{
+		// NTP version 4 client request.
+		Name:  "ntp",
+		Ports: []int{123},
+		Hex:   "e3 00 04 fa 00010000 00010000 00000000" + strings.Repeat("00", 32),
+	},
+	{
+		// SNMPv1 get-request for sysDescr.0 with community "public".
+		Name:  "snmp",
+		Ports: []int{161},
+		Hex:   "3029 020100 0406 7075626c6963 a01c 020412345678 020100 020100 300e 300c 06082b06010201010100 0500",
+	},
+	{
+		// SSDP discovery.
+		Name:  "ssdp",
+		Ports: []int{1900},
+		Hex: hex.EncodeToString([]byte("M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\n" +
+			"MAN: \"ssdp:discover\"\r\nMX: 1\r\nST: ssdp:all\r\n\r\n")),
+	},
+	{
+		// NetBIOS node status query for the wildcard name.
+		Name:  "netbios-ns",
+		Ports: []int{137},
+		Hex:   "a2d8 0000 0001 0000 0000 0000 20 434b414141414141414141414141414141414141414141414141414141414141 00 0021 0001",
+	},
+	{
+		// memcached version command with the UDP frame header.
+		Name:  "memcached",
+		Ports: []int{11211},
+		Hex:   "0001 0000 0001 0000" + hex.EncodeToString([]byte("version\r\n")),
+	},
+	{
+		// IKEv1 main mode with one 3DES/SHA1/PSK/MODP1024 proposal.
+		Name:  "ike",
+		Ports: []int{500, 4500},
+		Hex: "1122334455667788 0000000000000000 01 10 02 00 00000000 00000050" +
+			"00000034 00000001 00000001" +
+			"00000028 01010001" +
+			"00000020 01010000 80010005 80020002 80030001 80040002 800b0001 800c7080",
+	},
+	{
+		// ONC RPC portmapper NULL call.
+		Name:  "rpcbind",
+		Ports: []int{111},
+		Hex:   "72fe1d13 00000000 00000002 000186a0 00000002 00000000 00000000 00000000 00000000 00000000",
+	},
+	{
+		// mDNS query for the DNS-SD service list.
+		Name:  "mdns",
+		Ports: []int{5353},
+		Hex:   "0000 0000 0001 0000 0000 0000 095f7365727669636573 075f646e732d7364 045f756470 056c6f63616c 00 000c 0001",
+	},
+	{
+		// TFTP read request.
+		Name:  "tftp",
+		Ports: []int{69},
+		Hex:   "0001" + hex.EncodeToString([]byte("x\x00octet\x00")),
+	},
+	{
+		// SIP OPTIONS request.
+		Name:  "sip",
+		Ports: []int{5060},
+		Hex: hex.EncodeToString([]byte("OPTIONS sip:nm SIP/2.0\r\nVia: SIP/2.0/UDP nm;branch=z9hG4bK776asdhds\r\n" +
+			"From: <sip:nm@nm>;tag=root\r\nTo: <sip:nm2@nm2>\r\nCall-ID: 50000\r\nCSeq: 42 OPTIONS\r\n" +
+			"Max-Forwards: 70\r\nContent-Length: 0\r\n\r\n")),
+	},
+	{
+		// CoAP GET /.well-known/core.
+		Name:  "coap",
+		Ports: []int{5683},
+		Hex:   "400101ce bb2e77656c6c2d6b6e6f776e 04636f7265",
+	},
+	{
+		// OpenVPN hard reset from a client.
+		Name:  "openvpn",
+		Ports: []int{1194},
+		Hex:   "38 0102030405060708 00 00000000",
+	},
+	{
+		// Echo and chargen answer anything.
+		Name:  "echo",
+		Ports: []int{7, 19},
+		Hex:   "0d0a0d0a",
+	},
+}
+
+// payloadFor returns the probe name and payload sent to port.
+func payloadFor(port int) (string, []byte) {
+	for _, p := range udpPayloads {
+		for _, pp := range p.Ports {
+			if pp != port {
+				continue
+			}
+			payload, err := hex.DecodeString(strings.Join(strings.Fields(p.Hex), ""))
+			if err != nil {
+				panic("invalid UDP payload " + p.Name)
+			}
+			return p.Name, payload
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,17 @@
+package dnsrecord
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RdataString returns the record data of rrs in presentation format,
+// comma-separated, as the commands store answers in their logs and databases.
+func RdataString(rrs []dns.RR) string {
+	values := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		values = append(values, strings.TrimPrefix(rr.String(), rr.Header().String()))
+	}
+	return strings.Join(values, ",")
+}
@@ -0,0 +1,158 @@
+package ipcipher
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// KeySize is the size in bytes of the keys used by EncryptIP and DecryptIP.
+const KeySize = 16
+
+// DeriveKey derives an encryption key from a passphrase as described by the
+// ipcipher specification: PBKDF2-HMAC-SHA1 with the salt "ipcipheripcipher"
+// and 50,000 iterations.
+func DeriveKey(passphrase string) []byte {
+	return pbkdf2SHA1([]byte(passphrase), []byte("ipcipheripcipher"), 50000, KeySize)
+}
+
+// EncryptIP encrypts an IP address with a 16 byte key, returning an address
+// of the same family. IPv4 addresses are encrypted with ipcrypt and IPv6
+// addresses with a single AES-128 block.
+func EncryptIP(ip net.IP, key []byte) (net.IP, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes", KeySize)
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		state := [4]byte{v4[0], v4[1], v4[2], v4[3]}
+		for i := 0; i < 3; i++ {
+			xor4(&state, key[i*4:])
+			permuteForward(&state)
+		}
+		xor4(&state, key[12:])
+		return net.IP(state[:]), nil
+	}
+
+	if v6 := ip.To16(); v6 != nil {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		encrypted := make(net.IP, net.IPv6len)
+		block.Encrypt(encrypted, v6)
+		return encrypted, nil
+	}
+
+	return nil, fmt.Errorf("invalid ip address")
+}
+
+// DecryptIP reverses EncryptIP.
+func DecryptIP(ip net.IP, key []byte) (net.IP, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes", KeySize)
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		state := [4]byte{v4[0], v4[1], v4[2], v4[3]}
+		xor4(&state, key[12:])
+		for i := 2; i >= 0; i-- {
+			permuteBackward(&state)
+			xor4(&state, key[i*4:])
+		}
+		return net.IP(state[:]), nil
+	}
+
+	if v6 := ip.To16(); v6 != nil {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		decrypted := make(net.IP, net.IPv6len)
+		block.Decrypt(decrypted, v6)
+		return decrypted, nil
+	}
+
+	return nil, fmt.Errorf("invalid ip address")
+}
+
+// xor4 xors the first four bytes of key into state.
+func xor4(state *[4]byte, key []byte) {
+	for i := range state {
+		state[i] ^= key[i]
+	}
+}
+
+// rotl rotates b left by n bits.
+func rotl(b byte, n uint) byte {
+	return b<<n | b>>(8-n)
+}
+
+// permuteForward is the ipcrypt forward permutation.
+func permuteForward(s *[4]byte) {
+	s[0] += s[1]
+	s[2] += s[3]
+	s[1] = rotl(s[1], 2)
+	s[3] = rotl(s[3], 5)
+	s[1] ^= s[0]
+	s[3] ^= s[2]
+	s[0] = rotl(s[0], 4)
+	s[0] += s[3]
+	s[2] += s[1]
+	s[1] = rotl(s[1], 3)
+	s[3] = rotl(s[3], 7)
+	s[1] ^= s[2]
+	s[3] ^= s[0]
+	s[2] = rotl(s[2], 4)
+}
+
+// permuteBackward is the ipcrypt backward permutation.
+func permuteBackward(s *[4]byte) {
+	s[2] = rotl(s[2], 4)
+	s[1] ^= s[2]
+	s[3] ^= s[0]
+	s[1] = rotl(s[1], 5)
+	s[3] = rotl(s[3], 1)
+	s[0] -= s[3]
+	s[2] -= s[1]
+	s[0] = rotl(s[0], 4)
+	s[1] ^= s[0]
+	s[3] ^= s[2]
+	s[1] = rotl(s[1], 6)
+	s[3] = rotl(s[3], 3)
+	s[0] -= s[1]
+	s[2] -= s[3]
+}
+
+// pbkdf2SHA1 implements PBKDF2 (RFC 8018) with HMAC-SHA1.
+func pbkdf2SHA1(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var counter [4]byte
+	derived := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+		prf.Write(counter[:])
+		derived = prf.Sum(derived)
+		t := derived[len(derived)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+	return derived[:keyLen]
+}
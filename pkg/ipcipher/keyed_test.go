@@ -0,0 +1,94 @@
+package ipcipher
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// The IPv4 vectors are those of the ipcrypt reference implementation and the
+// IPv6 vectors those of the ipcipher specification, both for the key
+// "some 16-byte key".
+var keyedVectors = []struct {
+	plain, encrypted string
+}{
+	{"127.0.0.1", "114.62.227.59"},
+	{"8.8.8.8", "46.48.51.50"},
+	{"1.2.3.4", "171.238.15.199"},
+	{"::1", "3718:8853:1723:6c88:7e5f:2e60:c79a:2bf"},
+	{"2001:503:ba3e::2:30", "64d2:883d:ffb5:dd79:24b:943c:22aa:4ae7"},
+	{"2001:db8::", "ce7e:7e39:d282:e7b1:1d6d:5ca1:d4de:246f"},
+}
+
+func TestEncryptIPKnownAnswers(t *testing.T) {
+	key := []byte("some 16-byte key")
+	for _, tt := range keyedVectors {
+		encrypted, err := EncryptIP(net.ParseIP(tt.plain), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encrypted.String() != tt.encrypted {
+			t.Errorf("EncryptIP(%s) = %s, want %s", tt.plain, encrypted, tt.encrypted)
+		}
+
+		decrypted, err := DecryptIP(net.ParseIP(tt.encrypted), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !decrypted.Equal(net.ParseIP(tt.plain)) {
+			t.Errorf("DecryptIP(%s) = %s, want %s", tt.encrypted, decrypted, tt.plain)
+		}
+	}
+}
+
+func TestEncryptIPRoundTrip(t *testing.T) {
+	key := DeriveKey("some passphrase")
+	for _, address := range []string{"0.0.0.0", "192.0.2.1", "255.255.255.255", "::", "2001:db8::ffff:1"} {
+		ip := net.ParseIP(address)
+		encrypted, err := EncryptIP(ip, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (encrypted.To4() == nil) != (ip.To4() == nil) {
+			t.Errorf("EncryptIP(%s) = %s changed the address family", ip, encrypted)
+		}
+		decrypted, err := DecryptIP(encrypted, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !decrypted.Equal(ip) {
+			t.Errorf("DecryptIP(EncryptIP(%s)) = %s", ip, decrypted)
+		}
+	}
+}
+
+func TestEncryptIPRejectsBadKeys(t *testing.T) {
+	for _, key := range [][]byte{nil, []byte("short"), make([]byte, 32)} {
+		if _, err := EncryptIP(net.ParseIP("192.0.2.1"), key); err == nil {
+			t.Errorf("EncryptIP with a %d byte key succeeded", len(key))
+		}
+		if _, err := DecryptIP(net.ParseIP("192.0.2.1"), key); err == nil {
+			t.Errorf("DecryptIP with a %d byte key succeeded", len(key))
+		}
+	}
+}
+
+// TestPBKDF2SHA1 checks the key derivation against the RFC 6070 vectors.
+func TestPBKDF2SHA1(t *testing.T) {
+	for _, tt := range []struct {
+		password, salt string
+		iterations     int
+		derived        string
+	}{
+		{"password", "salt", 1, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{"password", "salt", 2, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{"password", "salt", 4096, "4b007901b765489abead49d926f721d065a429c1"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038"},
+		{"pass\x00word", "sa\x00lt", 4096, "56fa6aa75548099dcc37d7f03425e0c3"},
+	} {
+		derived := hex.EncodeToString(pbkdf2SHA1([]byte(tt.password), []byte(tt.salt), tt.iterations, len(tt.derived)/2))
+		if derived != tt.derived {
+			t.Errorf("pbkdf2SHA1(%q, %q, %d) = %s, want %s", tt.password, tt.salt, tt.iterations, derived, tt.derived)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package probename
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/clwg/netsecutils/pkg/ipcipher"
+	"github.com/miekg/dns"
+)
+
+// Encoding selects how the probed address is written into the first label of
+// a probe name.
+type Encoding int
+
+const (
+	// Plain writes IPv4 addresses as dashed octets (1-2-3-4) and IPv6
+	// addresses as 32 hexadecimal nibbles.
+	Plain Encoding = iota
+	// Dictionary substitutes each IPv4 octet with a word from an ipcipher
+	// dictionary (alpha-bravo-charlie-delta). IPv6 is not supported.
+	Dictionary
+	// Keyed encrypts the address with ipcipher and writes it in hexadecimal.
+	Keyed
+)
+
+// ParseEncoding parses an encoding name: plain, dictionary or keyed.
+func ParseEncoding(name string) (Encoding, error) {
+	switch strings.ToLower(name) {
+	case "plain", "":
+		return Plain, nil
+	case "dictionary":
+		return Dictionary, nil
+	case "keyed":
+		return Keyed, nil
+	}
+	return Plain, fmt.Errorf("unknown encoding %q", name)
+}
+
+// String returns the name of the encoding.
+func (e Encoding) String() string {
+	switch e {
+	case Dictionary:
+		return "dictionary"
+	case Keyed:
+		return "keyed"
+	}
+	return "plain"
+}
+
+// Probe is the information carried by a probe name.
+type Probe struct {
+	Target    net.IP
+	Timestamp time.Time // time the probe was sent, zero when not encoded
+	Scan      string    // identifier of the scan run, empty when not encoded
+}
+
+// Codec encodes probes into query names under a zone and decodes them again.
+// Names have the form <address>[.t<timestamp>][.s<scan>].<zone>, where the
+// timestamp is the send time in Unix milliseconds in base 36 and scan is a
+// lower case alphanumeric run identifier.
+type Codec struct {
+	Encoding   Encoding
+	Dictionary []string // lower case word list for Dictionary encoding
+	Key        []byte   // ipcipher key for Keyed encoding
+	Zone       string
+}
+
+// NewCodec returns a codec for the zone. The dictionary file is required for
+// Dictionary encoding and the passphrase for Keyed encoding.
+func NewCodec(zone string, encoding Encoding, dictionaryFile, passphrase string) (*Codec, error) {
+	codec := &Codec{
+		Encoding: encoding,
+		Zone:     strings.ToLower(dns.Fqdn(zone)),
+	}
+
+	switch encoding {
+	case Dictionary:
+		dictionary, err := ipcipher.BuildDictionary(dictionaryFile)
+		if err != nil {
+			return nil, err
+		}
+		// Resolvers may change the case of names, so match words in lower case.
+		for i, word := range dictionary {
+			dictionary[i] = strings.ToLower(word)
+		}
+		codec.Dictionary = dictionary
+	case Keyed:
+		if passphrase == "" {
+			return nil, fmt.Errorf("keyed encoding requires a passphrase")
+		}
+		codec.Key = ipcipher.DeriveKey(passphrase)
+	}
+	return codec, nil
+}
+
+// Encode returns the fully qualified query name for a probe.
+func (c *Codec) Encode(p Probe) (string, error) {
+	label, err := c.encodeAddress(p.Target)
+	if err != nil {
+		return "", err
+	}
+
+	labels := []string{label}
+	if !p.Timestamp.IsZero() {
+		labels = append(labels, "t"+strconv.FormatInt(p.Timestamp.UnixMilli(), 36))
+	}
+	if p.Scan != "" {
+		if !IsScanID(p.Scan) {
+			return "", fmt.Errorf("invalid scan identifier %q", p.Scan)
+		}
+		labels = append(labels, "s"+p.Scan)
+	}
+	labels = append(labels, c.Zone)
+	return strings.Join(labels, "."), nil
+}
+
+// Decode extracts the probe from a query name. Matching is case-insensitive,
+// so names whose case was randomised by resolvers decode correctly. Legacy
+// names carrying a dotted address (1.2.3.4.<zone>) are accepted with Plain
+// encoding.
+func (c *Codec) Decode(qname string) (Probe, error) {
+	qname = strings.ToLower(dns.Fqdn(qname))
+	if !dns.IsSubDomain(c.Zone, qname) || qname == c.Zone {
+		return Probe{}, fmt.Errorf("%s is not a probe name under %s", qname, c.Zone)
+	}
+
+	labels := dns.SplitDomainName(strings.TrimSuffix(qname, c.Zone))
+
+	if c.Encoding == Plain && len(labels) >= 4 {
+		if ip := net.ParseIP(strings.Join(labels[:4], ".")); ip != nil {
+			return Probe{Target: ip.To4()}, nil
+		}
+	}
+
+	var probe Probe
+	target, err := c.decodeAddress(labels[0])
+	if err != nil {
+		return Probe{}, err
+	}
+	probe.Target = target
+
+	for _, label := range labels[1:] {
+		switch {
+		case strings.HasPrefix(label, "t"):
+			millis, err := strconv.ParseInt(label[1:], 36, 64)
+			if err == nil {
+				probe.Timestamp = time.UnixMilli(millis)
+			}
+		case strings.HasPrefix(label, "s") && IsScanID(label[1:]):
+			probe.Scan = label[1:]
+		}
+	}
+	return probe, nil
+}
+
+// IsScanID reports whether id is 1 to 16 lower case letters and digits.
+func IsScanID(id string) bool {
+	if len(id) == 0 || len(id) > 16 {
+		return false
+	}
+	for _, r := range id {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeAddress returns the label holding ip.
+func (c *Codec) encodeAddress(ip net.IP) (string, error) {
+	switch c.Encoding {
+	case Dictionary:
+		if ip.To4() == nil {
+			return "", fmt.Errorf("dictionary encoding supports only IPv4 addresses")
+		}
+		return ipcipher.EncodeIPAddress(ip, c.Dictionary), nil
+	case Keyed:
+		encrypted, err := ipcipher.EncryptIP(ip, c.Key)
+		if err != nil {
+			return "", err
+		}
+		return addressToHex(encrypted), nil
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		return strings.ReplaceAll(v4.String(), ".", "-"), nil
+	}
+	if ip.To16() == nil {
+		return "", fmt.Errorf("invalid ip address")
+	}
+	return addressToHex(ip), nil
+}
+
+// decodeAddress reverses encodeAddress.
+func (c *Codec) decodeAddress(label string) (net.IP, error) {
+	switch c.Encoding {
+	case Dictionary:
+		return ipcipher.DecodeIPAddress(label, c.Dictionary)
+	case Keyed:
+		encrypted, err := hexToAddress(label)
+		if err != nil {
+			return nil, err
+		}
+		return ipcipher.DecryptIP(encrypted, c.Key)
+	}
+
+	if ip := net.ParseIP(strings.ReplaceAll(label, "-", ".")); ip != nil && strings.Contains(label, "-") {
+		return ip.To4(), nil
+	}
+	return hexToAddress(label)
+}
+
+// addressToHex writes an address as 8 (IPv4) or 32 (IPv6) hexadecimal digits.
+func addressToHex(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return hex.EncodeToString(v4)
+	}
+	return hex.EncodeToString(ip.To16())
+}
+
+// hexToAddress reverses addressToHex.
+func hexToAddress(label string) (net.IP, error) {
+	if len(label) != 2*net.IPv4len && len(label) != 2*net.IPv6len {
+		return nil, fmt.Errorf("invalid address label %q", label)
+	}
+	b, err := hex.DecodeString(label)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address label %q", label)
+	}
+	return net.IP(b), nil
+}
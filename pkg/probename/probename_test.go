@@ -0,0 +1,109 @@
+package probename
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCodecs returns a codec for each encoding under probe.example.com.
+func testCodecs(t *testing.T) []*Codec {
+	t.Helper()
+	words := make([]string, 256)
+	for i := range words {
+		words[i] = fmt.Sprintf("Word%d", i)
+	}
+	dictionaryFile := filepath.Join(t.TempDir(), "dictionary.txt")
+	if err := os.WriteFile(dictionaryFile, []byte(strings.Join(words, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var codecs []*Codec
+	for _, encoding := range []Encoding{Plain, Dictionary, Keyed} {
+		codec, err := NewCodec("Probe.Example.com", encoding, dictionaryFile, "some passphrase")
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		codecs = append(codecs, codec)
+	}
+	return codecs
+}
+
+func TestRoundTrip(t *testing.T) {
+	sent := time.UnixMilli(1700000000123)
+	for _, codec := range testCodecs(t) {
+		for _, address := range []string{"192.0.2.1", "0.0.0.0", "255.255.255.255", "2001:db8::1", "::"} {
+			ip := net.ParseIP(address)
+			for _, probe := range []Probe{
+				{Target: ip},
+				{Target: ip, Timestamp: sent},
+				{Target: ip, Scan: "r42"},
+				{Target: ip, Timestamp: sent, Scan: "0123456789abcdef"},
+			} {
+				name, err := codec.Encode(probe)
+				if codec.Encoding == Dictionary && ip.To4() == nil {
+					if err == nil {
+						t.Errorf("%s: encoded %s as %s, want an error", codec.Encoding, address, name)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%s: encoding %+v: %v", codec.Encoding, probe, err)
+				}
+				if !strings.HasSuffix(name, ".probe.example.com.") {
+					t.Errorf("%s: name %s is not under the zone", codec.Encoding, name)
+				}
+
+				// Resolvers may randomise the case of the name.
+				got, err := codec.Decode(strings.ToUpper(name))
+				if err != nil {
+					t.Fatalf("%s: decoding %s: %v", codec.Encoding, name, err)
+				}
+				if !got.Target.Equal(ip) || !got.Timestamp.Equal(probe.Timestamp) || got.Scan != probe.Scan {
+					t.Errorf("%s: %s decoded to %+v, want %+v", codec.Encoding, name, got, probe)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeRejectsInvalidScanID(t *testing.T) {
+	codec := testCodecs(t)[0]
+	for _, scan := range []string{"Scan", "a-b", "0123456789abcdefg"} {
+		if name, err := codec.Encode(Probe{Target: net.ParseIP("192.0.2.1"), Scan: scan}); err == nil {
+			t.Errorf("scan %q: encoded as %s, want an error", scan, name)
+		}
+	}
+}
+
+func TestDecodeRejectsForeignNames(t *testing.T) {
+	for _, codec := range testCodecs(t) {
+		for _, name := range []string{
+			"probe.example.com.",
+			"192-0-2-1.example.com.",
+			"192-0-2-1.probe.example.net.",
+			"www.probe.example.com.",
+			"c000020.probe.example.com.",
+			"zz000201.probe.example.com.",
+			"word1-word2-word3.probe.example.com.",
+		} {
+			if probe, err := codec.Decode(name); err == nil {
+				t.Errorf("%s: decoded %s to %+v, want an error", codec.Encoding, name, probe)
+			}
+		}
+	}
+}
+
+func TestDecodeLegacyDottedName(t *testing.T) {
+	probe, err := testCodecs(t)[0].Decode("192.0.2.1.probe.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !probe.Target.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("target = %s, want 192.0.2.1", probe.Target)
+	}
+}
@@ -0,0 +1,51 @@
+// Package ratelimit paces events such as probes to a fixed rate shared by all
+// the goroutines sending them.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// slack is how far ahead of its send time an event may go. Sleeps shorter
+// than the resolution of the system timer overshoot, so high rates are met by
+// sending the events due within slack together instead.
+const slack = time.Millisecond
+
+// Limiter hands out evenly spaced send times. Time a limiter spends idle is
+// not saved up for a later burst. A nil Limiter does not limit.
+type Limiter struct {
+	mu       sync.Mutex
+	start    time.Time
+	interval float64 // nanoseconds between events
+	next     float64 // nanoseconds after start of the next send time
+}
+
+// New returns a limiter allowing rate events per second, or nil when rate is
+// not positive.
+func New(rate int) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &Limiter{start: time.Now(), interval: float64(time.Second) / float64(rate)}
+}
+
+// Wait blocks until the next event may be sent.
+func (l *Limiter) Wait() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	now := float64(time.Since(l.start))
+	if l.next < now {
+		l.next = now
+	}
+	wait := time.Duration(l.next-now) - slack
+	l.next += l.interval
+	l.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
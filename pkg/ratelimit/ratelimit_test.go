@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNilLimiter(t *testing.T) {
+	for _, rate := range []int{0, -1} {
+		if l := New(rate); l != nil {
+			t.Errorf("New(%d) = %v, want nil", rate, l)
+		}
+	}
+
+	var l *Limiter
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		l.Wait()
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("nil limiter waited %v", elapsed)
+	}
+}
+
+func TestRate(t *testing.T) {
+	for _, tt := range []struct {
+		rate, events int
+		workers      int
+	}{
+		{100, 21, 1},
+		{100, 21, 8},
+		{20000, 4001, 8},
+	} {
+		l := New(tt.rate)
+		start := time.Now()
+		var wg sync.WaitGroup
+		events := make(chan struct{}, tt.events)
+		for i := 0; i < tt.events; i++ {
+			events <- struct{}{}
+		}
+		close(events)
+		for i := 0; i < tt.workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range events {
+					l.Wait()
+				}
+			}()
+		}
+		wg.Wait()
+
+		// The first event is sent at once and the last up to slack early.
+		want := time.Duration(tt.events-1)*time.Second/time.Duration(tt.rate) - slack
+		if elapsed := time.Since(start); elapsed < want || elapsed > want+100*time.Millisecond {
+			t.Errorf("rate %d: %d events with %d workers took %v, want %v", tt.rate, tt.events, tt.workers, elapsed, want)
+		}
+	}
+}
+
+func TestRateAboveTimerResolution(t *testing.T) {
+	for _, rate := range []int{2e9, math.MaxInt} {
+		l := New(rate)
+		start := time.Now()
+		for i := 0; i < 100000; i++ {
+			l.Wait()
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("rate %d: 100000 events took %v", rate, elapsed)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Package sqliteutil holds helpers shared by the commands that keep their
+// results in SQLite databases.
+package sqliteutil
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AddMissingColumns adds the given name and type pairs to table when it does
+// not have them yet, upgrading databases created by earlier versions in place.
+// Columns are added in order, so a failure leaves the earlier ones in place.
+func AddMissingColumns(db *sql.DB, table string, columns [][2]string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		existing[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, column := range columns {
+		if existing[column[0]] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column[0], column[1])); err != nil {
+			return fmt.Errorf("adding column %s to %s: %w", column[0], table, err)
+		}
+	}
+	return nil
+}
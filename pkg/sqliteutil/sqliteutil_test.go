@@ -0,0 +1,46 @@
+package sqliteutil
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestAddMissingColumns(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("CREATE TABLE queries (id INTEGER PRIMARY KEY, qname TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO queries (qname) VALUES ('example.com.')"); err != nil {
+		t.Fatal(err)
+	}
+
+	columns := [][2]string{{"qname", "TEXT"}, {"rtt", "REAL"}, {"tc", "BOOLEAN NOT NULL DEFAULT 0"}}
+	// Adding twice leaves the table as after the first time.
+	for i := 0; i < 2; i++ {
+		if err := AddMissingColumns(db, "queries", columns); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var qname string
+	var rtt sql.NullFloat64
+	var tc bool
+	if err := db.QueryRow("SELECT qname, rtt, tc FROM queries").Scan(&qname, &rtt, &tc); err != nil {
+		t.Fatal(err)
+	}
+	if qname != "example.com." || rtt.Valid || tc {
+		t.Errorf("row = %q, %v, %v, want the existing row with defaults", qname, rtt, tc)
+	}
+
+	if err := AddMissingColumns(db, "queries", [][2]string{{"bad", "NOT NULL"}}); err == nil {
+		t.Error("adding a NOT NULL column without default succeeded")
+	}
+}
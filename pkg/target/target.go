@@ -0,0 +1,430 @@
+// Package target parses the target specifications shared by the scanners into
+// an indexable list of addresses. A specification is a CIDR, an address range,
+// a single address or a hostname; comma-separated lists and @file references
+// are expanded. Overlapping targets are merged and exclusions subtracted
+// without materializing the address space, so a scan can visit the list in
+// any order and resume from an index.
+package target
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxFileDepth bounds nested @file references.
+const maxFileDepth = 8
+
+// addr is an IPv6 or IPv4-mapped address as a 128-bit integer.
+type addr struct {
+	hi, lo uint64
+}
+
+func fromIP(ip net.IP) addr {
+	ip16 := ip.To16()
+	return addr{hi: binary.BigEndian.Uint64(ip16[:8]), lo: binary.BigEndian.Uint64(ip16[8:])}
+}
+
+// ip returns the address, in 4-byte form for IPv4.
+func (a addr) ip() net.IP {
+	ip := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(ip[:8], a.hi)
+	binary.BigEndian.PutUint64(ip[8:], a.lo)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func (a addr) less(b addr) bool {
+	return a.hi < b.hi || (a.hi == b.hi && a.lo < b.lo)
+}
+
+func (a addr) add(n uint64) addr {
+	lo, carry := bits.Add64(a.lo, n, 0)
+	return addr{hi: a.hi + carry, lo: lo}
+}
+
+func (a addr) sub(n uint64) addr {
+	lo, borrow := bits.Sub64(a.lo, n, 0)
+	return addr{hi: a.hi - borrow, lo: lo}
+}
+
+// diff returns a-b and whether it fits in 64 bits.
+func (a addr) diff(b addr) (uint64, bool) {
+	lo, borrow := bits.Sub64(a.lo, b.lo, 0)
+	return lo, a.hi-b.hi-borrow == 0
+}
+
+// span is an inclusive range of addresses.
+type span struct {
+	first, last addr
+}
+
+// size returns the number of addresses in s, which is bounded by the parser.
+func (s span) size() uint64 {
+	n, _ := s.last.diff(s.first)
+	return n + 1
+}
+
+// Parser parses target specifications.
+type Parser struct {
+	// MaxIPv6Bits bounds each IPv6 network or range to 2^MaxIPv6Bits
+	// addresses, since large IPv6 networks cannot be scanned exhaustively.
+	// Zero means 32.
+	MaxIPv6Bits int
+
+	// Resolve looks up hostnames, net.LookupIP when nil.
+	Resolve func(host string) ([]net.IP, error)
+}
+
+// List is an indexable, deduplicated list of addresses.
+type List struct {
+	spans   []span
+	offsets []uint64 // index of the first address of each span
+	total   uint64
+	names   map[addr][]string // hostnames the addresses were resolved from
+}
+
+// Parse parses targets and exclusions with the default parser.
+func Parse(targets, exclude []string) (*List, error) {
+	return (&Parser{}).Parse(targets, exclude)
+}
+
+// Parse returns the addresses of targets that are not in exclude.
+func (p *Parser) Parse(targets, exclude []string) (*List, error) {
+	included, names, err := p.spans(targets)
+	if err != nil {
+		return nil, err
+	}
+	excluded, _, err := p.spans(exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &List{names: names}
+	for _, s := range subtract(merge(included), merge(excluded)) {
+		size := s.size()
+		if list.total+size < list.total {
+			return nil, fmt.Errorf("too many targets")
+		}
+		list.spans = append(list.spans, s)
+		list.offsets = append(list.offsets, list.total)
+		list.total += size
+	}
+	return list, nil
+}
+
+// Len returns the number of addresses in the list.
+func (l *List) Len() uint64 {
+	return l.total
+}
+
+// At returns the address at index i.
+func (l *List) At(i uint64) net.IP {
+	n := sort.Search(len(l.spans), func(n int) bool {
+		return l.offsets[n]+l.spans[n].size() > i
+	})
+	return l.spans[n].first.add(i - l.offsets[n]).ip()
+}
+
+// Names returns the hostnames ip was resolved from, in the order they were
+// given, or nil for addresses given as such.
+func (l *List) Names(ip net.IP) []string {
+	if ip.To16() == nil {
+		return nil
+	}
+	return l.names[fromIP(ip)]
+}
+
+// Contains reports whether ip is in the list.
+func (l *List) Contains(ip net.IP) bool {
+	if ip.To16() == nil {
+		return false
+	}
+	a := fromIP(ip)
+	n := sort.Search(len(l.spans), func(n int) bool {
+		return !l.spans[n].last.less(a)
+	})
+	return n < len(l.spans) && !a.less(l.spans[n].first)
+}
+
+// spans parses specs into address spans, and returns the hostnames each
+// resolved address was given as.
+func (p *Parser) spans(specs []string) ([]span, map[addr][]string, error) {
+	specs, err := Expand(specs)
+	if err != nil {
+		return nil, nil, err
+	}
+	var spans []span
+	names := make(map[addr][]string)
+	for _, spec := range specs {
+		s, resolved, err := p.parse(spec)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", spec, err)
+		}
+		spans = append(spans, s...)
+		if !resolved {
+			continue
+		}
+		name := strings.TrimSuffix(strings.ToLower(spec), ".")
+		for _, sp := range s {
+			if !contains(names[sp.first], name) {
+				names[sp.first] = append(names[sp.first], name)
+			}
+		}
+	}
+	return spans, names, nil
+}
+
+// parse parses a single CIDR, range, address or hostname, reporting whether
+// it was a resolved hostname.
+func (p *Parser) parse(spec string) ([]span, bool, error) {
+	maxBits := p.MaxIPv6Bits
+	if maxBits <= 0 {
+		maxBits = 32
+	}
+	if maxBits > 62 {
+		maxBits = 62
+	}
+	if !strings.Contains(spec, ":") {
+		// Every IPv4 network fits.
+		maxBits = 32
+	}
+
+	if strings.Contains(spec, "/") {
+		_, ipnet, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, false, err
+		}
+		ones, size := ipnet.Mask.Size()
+		if size-ones > maxBits {
+			return nil, false, fmt.Errorf("IPv6 networks may hold at most 2^%d addresses, use a list of addresses", maxBits)
+		}
+		first := fromIP(ipnet.IP)
+		return []span{{first: first, last: first.add(1<<uint(size-ones) - 1)}}, false, nil
+	}
+
+	if i := strings.Index(spec, "-"); i > 0 {
+		if start := net.ParseIP(spec[:i]); start != nil {
+			end, err := rangeEnd(start, spec[i+1:])
+			if err != nil {
+				return nil, false, err
+			}
+			first, last := fromIP(start), fromIP(end)
+			if last.less(first) {
+				return nil, false, fmt.Errorf("range ends before it starts")
+			}
+			if n, ok := last.diff(first); !ok || n >= 1<<uint(maxBits) {
+				return nil, false, fmt.Errorf("IPv6 ranges may hold at most 2^%d addresses", maxBits)
+			}
+			return []span{{first: first, last: last}}, false, nil
+		}
+	}
+
+	if ip := net.ParseIP(spec); ip != nil {
+		a := fromIP(ip)
+		return []span{{first: a, last: a}}, false, nil
+	}
+
+	resolve := p.Resolve
+	if resolve == nil {
+		resolve = net.LookupIP
+	}
+	ips, err := resolve(spec)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(ips) == 0 {
+		return nil, false, fmt.Errorf("no addresses")
+	}
+	var spans []span
+	for _, ip := range ips {
+		a := fromIP(ip)
+		spans = append(spans, span{first: a, last: a})
+	}
+	return spans, true, nil
+}
+
+// rangeEnd parses the end of a range, a full address of the same family or,
+// for IPv4, the last octet alone (192.0.2.10-20).
+func rangeEnd(start net.IP, end string) (net.IP, error) {
+	if ip := net.ParseIP(end); ip != nil {
+		if (ip.To4() == nil) != (start.To4() == nil) {
+			return nil, fmt.Errorf("range mixes IPv4 and IPv6")
+		}
+		return ip, nil
+	}
+	start4 := start.To4()
+	octet, err := strconv.ParseUint(end, 10, 8)
+	if start4 == nil || err != nil {
+		return nil, fmt.Errorf("invalid range end %q", end)
+	}
+	return net.IPv4(start4[0], start4[1], start4[2], byte(octet)), nil
+}
+
+// merge sorts spans and joins overlapping and adjacent ones.
+func merge(spans []span) []span {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].first.less(spans[j].first) })
+
+	var merged []span
+	for _, s := range spans {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if !last.last.add(1).less(s.first) || last.last == (addr{^uint64(0), ^uint64(0)}) {
+				if last.last.less(s.last) {
+					last.last = s.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// subtract removes the excluded spans from the included ones; both are
+// sorted and merged.
+func subtract(included, excluded []span) []span {
+	var result []span
+	j := 0
+	for _, s := range included {
+		for j < len(excluded) && excluded[j].last.less(s.first) {
+			j++
+		}
+		empty := false
+		for k := j; k < len(excluded) && !s.last.less(excluded[k].first); k++ {
+			ex := excluded[k]
+			if s.first.less(ex.first) {
+				result = append(result, span{first: s.first, last: ex.first.sub(1)})
+			}
+			if !ex.last.less(s.last) {
+				empty = true
+				break
+			}
+			s.first = ex.last.add(1)
+		}
+		if !empty {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// Expand flattens comma-separated lists and @file references into single
+// specifications. Files hold specifications one per line, with blank lines
+// and comments starting with # ignored.
+func Expand(specs []string) ([]string, error) {
+	return expand(specs, 0)
+}
+
+func expand(specs []string, depth int) ([]string, error) {
+	var expanded []string
+	for _, spec := range specs {
+		for _, item := range SplitList(spec) {
+			if !strings.HasPrefix(item, "@") {
+				expanded = append(expanded, item)
+				continue
+			}
+			if depth >= maxFileDepth {
+				return nil, fmt.Errorf("%s: too many nested files", item)
+			}
+			lines, err := ReadFile(item[1:])
+			if err != nil {
+				return nil, err
+			}
+			items, err := expand(lines, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, items...)
+		}
+	}
+	return expanded, nil
+}
+
+// ReadFile reads one specification per line from path, ignoring blank lines
+// and comments starting with #.
+func ReadFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var specs []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if line != "" {
+			specs = append(specs, line)
+		}
+	}
+	return specs, scanner.Err()
+}
+
+// contains reports whether list holds s.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitList splits a comma-separated list, dropping empty items.
+func SplitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Permutation maps scan positions to list indexes. A random permutation is
+// the affine map i -> (a*i + b) mod n with a coprime to n, which visits every
+// index once, spreads consecutive positions across the target space and is
+// reproduced exactly from the seed when a scan is resumed.
+type Permutation struct {
+	n, a, b uint64
+}
+
+// NewPermutation returns a permutation of n indexes, the identity unless
+// random is set.
+func NewPermutation(n uint64, seed int64, random bool) Permutation {
+	if !random || n < 2 {
+		return Permutation{n: n, a: 1}
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	a := uint64(rng.Int63())%n | 1
+	for gcd(a, n) != 1 {
+		a = (a + 2) % n
+	}
+	return Permutation{n: n, a: a, b: uint64(rng.Int63()) % n}
+}
+
+// At returns the index visited at position i.
+func (p Permutation) At(i uint64) uint64 {
+	hi, lo := bits.Mul64(p.a, i)
+	_, rem := bits.Div64(hi%p.n, lo, p.n)
+	return (rem + p.b) % p.n
+}
+
+// gcd returns the greatest common divisor of a and b.
+func gcd(a, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
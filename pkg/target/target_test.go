@@ -0,0 +1,164 @@
+package target
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// addresses returns every address of l as strings.
+func addresses(l *List) []string {
+	var ips []string
+	for i := uint64(0); i < l.Len(); i++ {
+		ips = append(ips, l.At(i).String())
+	}
+	return ips
+}
+
+func TestParse(t *testing.T) {
+	dir := t.TempDir()
+	inner := filepath.Join(dir, "inner.txt")
+	if err := os.WriteFile(inner, []byte("192.0.2.200\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	outer := filepath.Join(dir, "outer.txt")
+	if err := os.WriteFile(outer, []byte("# hit list\n192.0.2.100 # trailing comment\n\n@"+inner+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name             string
+		targets, exclude []string
+		want             string // comma-separated addresses
+	}{
+		{"cidr", []string{"192.0.2.0/30"}, nil, "192.0.2.0,192.0.2.1,192.0.2.2,192.0.2.3"},
+		{"cidr host bits", []string{"192.0.2.5/31"}, nil, "192.0.2.4,192.0.2.5"},
+		{"range", []string{"192.0.2.254-192.0.3.1"}, nil, "192.0.2.254,192.0.2.255,192.0.3.0,192.0.3.1"},
+		{"short range", []string{"192.0.2.10-12"}, nil, "192.0.2.10,192.0.2.11,192.0.2.12"},
+		{"ipv6 range", []string{"2001:db8::ff-2001:db8::101"}, nil, "2001:db8::ff,2001:db8::100,2001:db8::101"},
+		{"list", []string{"192.0.2.9, 2001:db8::1,,192.0.2.8"}, nil, "192.0.2.8,192.0.2.9,2001:db8::1"},
+		{"file", []string{"@" + outer}, nil, "192.0.2.100,192.0.2.200"},
+		{"overlap", []string{"192.0.2.0/30", "192.0.2.2-192.0.2.5", "192.0.2.3"}, nil, "192.0.2.0,192.0.2.1,192.0.2.2,192.0.2.3,192.0.2.4,192.0.2.5"},
+		{"adjacent", []string{"192.0.2.4/31", "192.0.2.0/30"}, nil, "192.0.2.0,192.0.2.1,192.0.2.2,192.0.2.3,192.0.2.4,192.0.2.5"},
+		{"exclude middle", []string{"192.0.2.0/29"}, []string{"192.0.2.2-3", "192.0.2.5"}, "192.0.2.0,192.0.2.1,192.0.2.4,192.0.2.6,192.0.2.7"},
+		{"exclude edges", []string{"192.0.2.0/30", "192.0.2.8/30"}, []string{"192.0.2.0", "192.0.2.3-192.0.2.8", "192.0.2.11"}, "192.0.2.1,192.0.2.2,192.0.2.9,192.0.2.10"},
+		{"exclude all", []string{"192.0.2.0/30"}, []string{"192.0.2.0/24"}, ""},
+		{"exclude outside", []string{"192.0.2.1"}, []string{"198.51.100.0/24", "2001:db8::/96"}, "192.0.2.1"},
+		{"hostname", []string{"Scanme.Example.com."}, nil, "192.0.2.7,2001:db8::7"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			parser := &Parser{Resolve: func(host string) ([]net.IP, error) {
+				return []net.IP{net.ParseIP("2001:db8::7"), net.ParseIP("192.0.2.7")}, nil
+			}}
+			list, err := parser.Parse(tt.targets, tt.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(addresses(list), ","); got != tt.want {
+				t.Errorf("addresses = %s, want %s", got, tt.want)
+			}
+			for _, ip := range addresses(list) {
+				if !list.Contains(net.ParseIP(ip)) {
+					t.Errorf("Contains(%s) = false", ip)
+				}
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	parser := &Parser{Resolve: func(host string) ([]net.IP, error) {
+		return nil, fmt.Errorf("no such host")
+	}}
+	for _, spec := range []string{
+		"192.0.2.0/33",
+		"192.0.2.10-9",
+		"192.0.2.1-2001:db8::1",
+		"192.0.2.1-256",
+		"2001:db8::/64",
+		"2001:db8::-2001:db8::1:0:0",
+		"no-such-host.example.com",
+		"@" + filepath.Join(t.TempDir(), "missing.txt"),
+	} {
+		if list, err := parser.Parse([]string{spec}, nil); err == nil {
+			t.Errorf("Parse(%s) = %d addresses, want an error", spec, list.Len())
+		}
+	}
+}
+
+func TestParseLargeNetworks(t *testing.T) {
+	list, err := Parse([]string{"0.0.0.0/0"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Len() != 1<<32 {
+		t.Errorf("0.0.0.0/0 holds %d addresses, want 2^32", list.Len())
+	}
+	if first, last := list.At(0), list.At(list.Len()-1); first.String() != "0.0.0.0" || last.String() != "255.255.255.255" {
+		t.Errorf("0.0.0.0/0 runs from %s to %s", first, last)
+	}
+
+	// The default IPv6 limit is 2^32 addresses per network or range.
+	if list, err := Parse([]string{"2001:db8::/96", "2001:db8:1::-2001:db8:1::ffff:ffff"}, nil); err != nil || list.Len() != 1<<33 {
+		t.Errorf("IPv6 networks of 2^32 addresses: %v", err)
+	}
+	for _, spec := range []string{"2001:db8::/95", "2001:db8::-2001:db8::1:0:0"} {
+		if _, err := Parse([]string{spec}, nil); err == nil {
+			t.Errorf("Parse(%s) accepted more than 2^32 addresses", spec)
+		}
+	}
+	if _, err := (&Parser{MaxIPv6Bits: 40}).Parse([]string{"2001:db8::/88"}, nil); err != nil {
+		t.Errorf("MaxIPv6Bits 40 rejected a /88: %v", err)
+	}
+	if _, err := (&Parser{MaxIPv6Bits: 8}).Parse([]string{"2001:db8::/119"}, nil); err == nil {
+		t.Error("MaxIPv6Bits 8 accepted a /119")
+	}
+}
+
+func TestNames(t *testing.T) {
+	parser := &Parser{Resolve: func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	}}
+	list, err := parser.Parse([]string{"www.example.com", "192.0.2.0/30", "Example.com."}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Len() != 4 {
+		t.Errorf("got %d addresses, want 4", list.Len())
+	}
+	if got := strings.Join(list.Names(net.ParseIP("192.0.2.1")), ","); got != "www.example.com,example.com" {
+		t.Errorf("Names(192.0.2.1) = %s", got)
+	}
+	if names := list.Names(net.ParseIP("192.0.2.2")); names != nil {
+		t.Errorf("Names(192.0.2.2) = %v, want none", names)
+	}
+}
+
+func TestPermutationIsBijective(t *testing.T) {
+	for n := uint64(0); n <= 64; n++ {
+		for seed := int64(0); seed < 8; seed++ {
+			for _, random := range []bool{false, true} {
+				p := NewPermutation(n, seed, random)
+				seen := make([]bool, n)
+				for i := uint64(0); i < n; i++ {
+					j := p.At(i)
+					if j >= n || seen[j] {
+						t.Fatalf("n %d, seed %d, random %v: position %d maps to %d again or out of range", n, seed, random, i, j)
+					}
+					seen[j] = true
+				}
+				if !random && n > 0 && p.At(n-1) != n-1 {
+					t.Errorf("n %d: the ordered permutation is not the identity", n)
+				}
+			}
+		}
+	}
+
+	// A permutation is reproduced from its seed.
+	if NewPermutation(1000, 42, true) != NewPermutation(1000, 42, true) {
+		t.Error("the same seed gave different permutations")
+	}
+}